@@ -0,0 +1,175 @@
+// Package api defines the types the validator's HTTP API responds with, so
+// that Go clients can decode responses into the same types the server
+// encodes.
+package api
+
+import "time"
+
+// ValidationResponse is the result of validating a single document.
+type ValidationResponse struct {
+	Valid      bool     `json:"valid"`
+	Errors     []string `json:"errors"`
+	Warnings   []string `json:"warnings"`
+	Schema     string   `json:"schema"`
+	SchemaYear int      `json:"year"`
+	// MaxErrors is the most errors the response lists.
+	MaxErrors int `json:"max_errors"`
+	// Truncated is set if there were more errors than listed.
+	// SuppressedErrors counts those that were found but left out; when the
+	// server's ceiling was reached there may be others beyond it.
+	Truncated        bool `json:"truncated"`
+	SuppressedErrors int  `json:"suppressed_errors"`
+	// FailFast is set if validation stopped once MaxErrors errors were
+	// found, so SuppressedErrors isn't counted.
+	FailFast bool `json:"fail_fast,omitempty"`
+	// Findings holds the errors and warnings above in structured form. It
+	// is left out when there are none.
+	Findings []Finding `json:"findings,omitempty"`
+	// Summary groups all errors and warnings, including suppressed ones,
+	// by rule and path.
+	Summary []RuleSummary `json:"summary"`
+	// NPIVerification says how provider NPIs were checked. It is only set
+	// for providers files.
+	NPIVerification string `json:"npi_verification,omitempty"`
+}
+
+// NPI verification modes.
+const (
+	// NPIVerified means NPIs were looked up in the NPI data.
+	NPIVerified = "verified"
+	// NPIChecksumOnly means the server has no NPI data, so only NPI check
+	// digits were verified.
+	NPIChecksumOnly = "checksum_only"
+)
+
+// Finding severities.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Finding is a machine-readable form of a single validation error or
+// warning, so that clients don't have to pick apart the message strings in
+// ValidationResponse.Errors and ValidationResponse.Warnings.
+type Finding struct {
+	Severity string `json:"severity"`
+	// Path is the gojsonschema context of the offending value, e.g.
+	// "(root).3.plans.0.plan_id". Empty if the message carried no path.
+	Path string `json:"path"`
+	// Record is the index of the top-level array element the finding
+	// belongs to, or -1 if it isn't tied to a single record.
+	Record int `json:"record"`
+	// Rule is the JSON schema keyword that failed, e.g. "pattern" or
+	// "required", or one of our own rules such as "planReference". Empty
+	// for findings that don't map to a known rule.
+	Rule    string      `json:"rule"`
+	Value   interface{} `json:"value,omitempty"`
+	Message string      `json:"message"`
+	// Description is Message without the path and value.
+	Description string `json:"description"`
+	// RecordPosition is where the record starts, and Position where the
+	// offending value starts, when they could be found.
+	RecordPosition *Position `json:"record_position,omitempty"`
+	Position       *Position `json:"position,omitempty"`
+}
+
+// Position locates a value in a JSON document. Line and Column start at 1;
+// Column counts characters, not bytes. They are left out when the document
+// couldn't be re-read to find them, as for crawled files.
+type Position struct {
+	Offset int64 `json:"offset"`
+	Line   int   `json:"line,omitempty"`
+	Column int   `json:"column,omitempty"`
+}
+
+// RuleSummary counts the findings that share a severity, rule, path template
+// and message, e.g. every record whose addresses have a bad zip.
+type RuleSummary struct {
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	// Path is the findings' path with array indexes replaced by [*], e.g.
+	// "[*].addresses[*].zip".
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+	// Records lists the first few record indexes the findings belong to.
+	Records []int `json:"records"`
+}
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// Job is an asynchronous validation of an uploaded document, submitted to
+// /jobs.
+type Job struct {
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	Schema     string    `json:"schema"`
+	SchemaYear int       `json:"year"`
+	MaxErrors  int       `json:"max_errors"`
+	Created    time.Time `json:"created"`
+	// Progress, updated atomically while the job runs.
+	RecordsProcessed int64 `json:"records_processed"`
+	BytesRead        int64 `json:"bytes_read"`
+	BytesTotal       int64 `json:"bytes_total"`
+	// Result is set once State is JobDone.
+	Result *ValidationResponse `json:"result,omitempty"`
+}
+
+// ErrorResponse is the body of a 400 response to a malformed request.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// SupportedYears lists the plan years that may be asked for, when the
+	// year was the problem.
+	SupportedYears []int `json:"supported_years,omitempty"`
+}
+
+// SchemaInfo describes a schema the server can validate against.
+type SchemaInfo struct {
+	Name string `json:"name"`
+	// Years lists the plan years the schema can be validated for.
+	Years []int `json:"years"`
+}
+
+// Stream event types.
+const (
+	EventProgress = "progress"
+	EventFinding  = "finding"
+	EventResult   = "result"
+)
+
+// StreamEvent is a line of a streamed NDJSON response, or the data of a
+// server-sent event, depending on the format asked for.
+type StreamEvent struct {
+	Event string `json:"event"`
+	// Records and Bytes count how much of the document has been
+	// validated, for progress events.
+	Records int64 `json:"records,omitempty"`
+	Bytes   int64 `json:"bytes,omitempty"`
+	// BytesTotal is the size of the document, for progress events.
+	BytesTotal int64 `json:"bytes_total,omitempty"`
+	// Finding is sent as soon as it is found, for finding events, so it
+	// may not have its positions yet.
+	Finding *Finding `json:"finding,omitempty"`
+	// Result is the final response, for result events, with the findings
+	// it lists located.
+	Result *ValidationResponse `json:"result,omitempty"`
+}
+
+// ArchiveResponse is the response for a zip archive of documents, with a
+// response for each document in it.
+type ArchiveResponse struct {
+	Valid bool           `json:"valid"`
+	Files []FileResponse `json:"files"`
+}
+
+// FileResponse is the response for a document in an archive, named by its
+// path in the archive.
+type FileResponse struct {
+	Name string `json:"name"`
+	ValidationResponse
+}
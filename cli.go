@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// Exit statuses for the validate subcommand.
+const (
+	exitValid   = 0
+	exitInvalid = 1
+	exitUsage   = 2
+)
+
+// runValidate implements the "validate" subcommand, which checks local files
+// against a schema without starting the HTTP server:
+//
+//	coverage-validator [-d npis.csv] validate -schema providers -year 2018 file.json...
+//
+// It returns exitValid if every file is valid, exitInvalid if any file has
+// errors, and exitUsage for bad arguments or unreadable files.
+func runValidate(v Validator, args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	schemaName := fs.String("schema", "", "schema to validate against (plans, providers, drugs or index)")
+	year := fs.Int("year", 0, "plan year to validate for")
+	maxErrors := fs.Int("max-errors", defaultMaxErrors, "most errors to list per file")
+	failFast := fs.Bool("fail-fast", false, "stop validating each file once -max-errors errors are found")
+	format := fs.String("format", formatText, "output format: text, json, junit, sarif, html or csv")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *schemaName == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: coverage-validator validate -schema name -year year file...")
+		return exitUsage
+	}
+
+	if _, err := v.parseYear(*schemaName, strconv.Itoa(*year)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v; supported years: %v\n", err, err.(*yearError).supported)
+		return exitUsage
+	}
+
+	status := exitValid
+	var resps []namedResponse
+	for _, filename := range fs.Args() {
+		fileResps, err := validateFile(v, *schemaName, *year, *maxErrors, *failFast, filename, *format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return exitUsage
+		}
+		for _, resp := range fileResps {
+			resps = append(resps, resp)
+			if !resp.Valid && status == exitValid {
+				status = exitInvalid
+			}
+		}
+	}
+	if err := printResponses(os.Stdout, *format, resps); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	return status
+}
+
+// validateFile runs a local file through the same validation path as the
+// /validate endpoint, filling in the record details format uses. The file
+// may be compressed, or a zip archive with a response for each document.
+func validateFile(v Validator, schemaName string, year, maxErrors int, failFast bool, filename, format string) ([]namedResponse, error) {
+	var resp api.ValidationResponse
+	resp.Schema = schemaName
+	resp.SchemaYear = coverage.Year2SchemaYear(year)
+	resp.MaxErrors = parseMaxErrors(strconv.Itoa(maxErrors))
+	resp.FailFast = failFast
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	u := &uploads{validate: v.validateDoc, format: format}
+	if err := u.add(resp, f, filename, ""); err != nil {
+		return nil, err
+	}
+	return u.resps, nil
+}
+
+func printResponse(w io.Writer, filename string, resp api.ValidationResponse) {
+	if resp.Valid {
+		fmt.Fprintf(w, "%s: valid\n", filename)
+	} else {
+		fmt.Fprintf(w, "%s: invalid\n", filename)
+	}
+	printFindings(w, resp.Findings, api.SeverityError)
+	if resp.SuppressedErrors > 0 {
+		fmt.Fprintf(w, "  ... %d more errors not shown\n", resp.SuppressedErrors)
+	} else if resp.Truncated {
+		fmt.Fprintln(w, "  ... error limit reached, there may be more errors")
+	}
+	printFindings(w, resp.Findings, api.SeverityWarning)
+	if resp.NPIVerification == api.NPIChecksumOnly {
+		fmt.Fprintln(w, "  note: no NPI data loaded, NPIs were only checked for valid check digits")
+	}
+}
+
+// printFindings prints the findings of the given severity, prefixed with
+// their line and column when known.
+func printFindings(w io.Writer, findings []api.Finding, severity string) {
+	for _, f := range findings {
+		if f.Severity == severity {
+			fmt.Fprintf(w, "  %s: %s%s\n", f.Severity, findingLocation(f), f.Message)
+		}
+	}
+}
+
+// formatText is the CLI's default output format, besides the report
+// formats.
+const formatText = "text"
+
+// printResponses prints resps in the given format.
+func printResponses(w io.Writer, format string, resps []namedResponse) error {
+	switch format {
+	case formatText:
+		for _, resp := range resps {
+			printResponse(w, resp.Name, resp.ValidationResponse)
+		}
+		return nil
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		for _, resp := range resps {
+			if err := enc.Encode(resp.ValidationResponse); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeReport(w, format, resps)
+}
+
+// runCrawl implements the "crawl" subcommand, which validates an issuer's
+// index.json and every file it lists:
+//
+//	coverage-validator crawl -year 2018 https://example.com/index.json
+func runCrawl(c *Crawler, args []string) int {
+	fs := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	year := fs.Int("year", 0, "plan year to validate for")
+	maxErrors := fs.Int("max-errors", defaultMaxErrors, "most errors to list per file")
+	format := fs.String("format", formatText, "output format: text, json, junit, sarif, html or csv")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: coverage-validator crawl -year year index-url")
+		return exitUsage
+	}
+
+	if _, err := c.Validator.parseYear("index", strconv.Itoa(*year)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v; supported years: %v\n", err, err.(*yearError).supported)
+		return exitUsage
+	}
+
+	resp := c.Crawl(context.Background(), fs.Arg(0), *year, parseMaxErrors(strconv.Itoa(*maxErrors)))
+	if err := printResponses(os.Stdout, *format, resp.namedResponses()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if !resp.Valid {
+		return exitInvalid
+	}
+	return exitValid
+}
+
+// fileList is a flag.Value collecting repeated file arguments.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// runXref implements the "xref" subcommand, which checks local providers and
+// drugs files for plan references missing from the issuer's plans files:
+//
+//	coverage-validator xref -plans plans.json -providers providers.json -drugs drugs.json
+//
+// Each flag may be repeated.
+func runXref(args []string) int {
+	var plansFiles, providersFiles, drugsFiles fileList
+	fs := flag.NewFlagSet("xref", flag.ContinueOnError)
+	fs.Var(&plansFiles, "plans", "plans file to index (repeatable)")
+	fs.Var(&providersFiles, "providers", "providers file to check (repeatable)")
+	fs.Var(&drugsFiles, "drugs", "drugs file to check (repeatable)")
+	format := fs.String("format", formatText, "output format: text, json, junit, sarif, html or csv")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if len(plansFiles) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: coverage-validator xref -plans file [-providers file] [-drugs file]")
+		return exitUsage
+	}
+
+	plans := NewPlanIndex()
+	for _, filename := range plansFiles {
+		f, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return exitUsage
+		}
+		err = plans.Add(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return exitUsage
+		}
+	}
+
+	status := exitValid
+	var resps []namedResponse
+	for _, files := range []struct {
+		schema    string
+		filenames []string
+		check     func(io.Reader, int) core.ValidationResult
+	}{
+		{"providers", providersFiles, plans.CheckProviders},
+		{"drugs", drugsFiles, plans.CheckDrugs},
+	} {
+		for _, filename := range files.filenames {
+			f, err := os.Open(filename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+				return exitUsage
+			}
+			resp := api.ValidationResponse{Schema: files.schema}
+			result := files.check(f, *maxErrorsCeiling)
+			f.Close()
+			renderWarningsErrors(&resp, &result)
+			resps = append(resps, namedResponse{Name: filename, ValidationResponse: resp})
+			if !resp.Valid {
+				status = exitInvalid
+			}
+		}
+	}
+	if err := printResponses(os.Stdout, *format, resps); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	return status
+}
+
+// runNPIIndex implements the "npi-index" subcommand, which writes the NPI
+// file loaded with -d as a compact index that loads much faster:
+//
+//	coverage-validator -d npidata.csv.bz2 npi-index npis.idx
+func runNPIIndex(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: coverage-validator -d npi-file npi-index index-file")
+		return exitUsage
+	}
+	data := currentNPIs()
+	if data == nil {
+		fmt.Fprintln(os.Stderr, "no NPI data loaded")
+		return exitUsage
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return exitUsage
+	}
+	_, err = data.lookup.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return exitUsage
+	}
+	return exitValid
+}
@@ -0,0 +1,143 @@
+// Package client calls a coverage validator's /validate and /jobs APIs.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// Client validates documents against a validator server.
+type Client struct {
+	// BaseURL is the server's URL, e.g. "https://validator.example.com".
+	BaseURL string
+	// HTTPClient is used for requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// MaxErrors is the most errors a response should list, or 0 for the
+	// server's default.
+	MaxErrors int
+	// Async submits documents as jobs and polls for the result, for files
+	// too large to validate within the server's request timeout.
+	Async bool
+	// PollInterval is how often job results are polled for; one second
+	// if zero.
+	PollInterval time.Duration
+}
+
+// New returns a Client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Validate validates the document read from doc against the named schema
+// for the given plan year. The document is streamed to the server rather
+// than buffered.
+func (c *Client) Validate(ctx context.Context, schema string, year int, doc io.Reader) (*api.ValidationResponse, error) {
+	if !c.Async {
+		var resp api.ValidationResponse
+		if err := c.post(ctx, "/validate", schema, year, doc, http.StatusOK, &resp); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	}
+
+	var j api.Job
+	if err := c.post(ctx, "/jobs", schema, year, doc, http.StatusAccepted, &j); err != nil {
+		return nil, err
+	}
+	defer c.do(context.Background(), "DELETE", "/jobs/"+j.ID, nil, "", http.StatusNoContent, nil)
+
+	interval := c.PollInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	for j.State != api.JobDone {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if err := c.do(ctx, "GET", "/jobs/"+j.ID, nil, "", http.StatusOK, &j); err != nil {
+			return nil, err
+		}
+	}
+	if j.Result == nil {
+		return nil, errors.New("client: job finished without a result")
+	}
+	return j.Result, nil
+}
+
+// post sends a multipart form in the order the server reads it, with the
+// document last so it can be validated as it arrives.
+func (c *Client) post(ctx context.Context, path, schema string, year int, doc io.Reader, status int, v interface{}) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeForm(mw, schema, year, c.MaxErrors, doc))
+	}()
+	err := c.do(ctx, "POST", path, pr, mw.FormDataContentType(), status, v)
+	// unblock the writer if the request failed before reading the body
+	pr.Close()
+	return err
+}
+
+func writeForm(mw *multipart.Writer, schema string, year, maxErrors int, doc io.Reader) error {
+	fields := [][2]string{
+		{"schemaYear", strconv.Itoa(year)},
+		{"schema", schema},
+	}
+	if maxErrors > 0 {
+		fields = append(fields, [2]string{"maxErrors", strconv.Itoa(maxErrors)})
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	part, err := mw.CreateFormField("json")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, doc); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string, status int, v interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("client: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Compression formats of uploaded documents.
+const (
+	compressGzip  = "gzip"
+	compressBzip2 = "bzip2"
+	compressZip   = "zip"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zipMagic   = []byte("PK\x03\x04")
+)
+
+// maxArchiveFiles bounds how many documents a zip archive may hold.
+const maxArchiveFiles = 100
+
+// uploadError is an upload that can't be read, as opposed to a document
+// that doesn't validate.
+type uploadError struct {
+	err error
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+// decompress returns a reader for the uncompressed contents of r, which may
+// be gzip or bzip2 compressed or not compressed at all. The format is
+// detected from its magic bytes.
+func decompress(r io.Reader) (io.Reader, error) {
+	r, magic, err := peekMagic(r)
+	if err != nil {
+		return nil, err
+	}
+	return decompressAs(r, magicCompression(magic))
+}
+
+func decompressAs(r io.Reader, format string) (io.Reader, error) {
+	switch format {
+	case compressGzip:
+		return gzip.NewReader(r)
+	case compressBzip2:
+		return bzip2.NewReader(r), nil
+	default:
+		return r, nil
+	}
+}
+
+// peekMagic returns the first bytes of r and a reader for all of r. A
+// seekable r is returned itself, seeked back to where it was, so that the
+// document can still be re-read.
+func peekMagic(r io.Reader) (io.Reader, []byte, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if off, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			magic := make([]byte, len(zipMagic))
+			n, err := io.ReadFull(rs, magic)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, nil, err
+			}
+			if _, err := rs.Seek(off, io.SeekStart); err != nil {
+				return nil, nil, err
+			}
+			return rs, magic[:n], nil
+		}
+	}
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zipMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return br, magic, nil
+}
+
+func magicCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return compressGzip
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return compressBzip2
+	case bytes.HasPrefix(magic, zipMagic):
+		return compressZip
+	}
+	return ""
+}
+
+// uploadCompression returns the compression format an upload declares with
+// its Content-Encoding or, failing that, the extension of its file name, or
+// "" if it declares none.
+func uploadCompression(name, encoding string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		return compressGzip, nil
+	case "bzip2", "x-bzip2":
+		return compressBzip2, nil
+	default:
+		return "", fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		return compressGzip, nil
+	case ".bz2":
+		return compressBzip2, nil
+	case ".zip":
+		return compressZip, nil
+	}
+	return "", nil
+}
+
+// openUpload returns the contents of an upload named name and sent with
+// the given Content-Encoding, decompressed as the encoding, the name or
+// failing those the magic bytes say. It also reports whether the contents
+// are a zip archive, to be read with readZip. Errors are *uploadErrors.
+func openUpload(r io.Reader, name, encoding string) (io.Reader, bool, error) {
+	format, err := uploadCompression(name, encoding)
+	if err != nil {
+		return nil, false, &uploadError{err}
+	}
+	r, magic, err := peekMagic(r)
+	if err != nil {
+		return nil, false, &uploadError{err}
+	}
+	if format == "" {
+		format = magicCompression(magic)
+	}
+	switch format {
+	case "":
+		return r, false, nil
+	case compressZip:
+		return r, true, nil
+	}
+
+	if r, err = decompressAs(r, format); err != nil {
+		return nil, false, &uploadError{fmt.Errorf("reading %s upload: %v", format, err)}
+	}
+	// a compressed zip archive is still an archive
+	if r, magic, err = peekMagic(r); err != nil {
+		return nil, false, &uploadError{fmt.Errorf("reading %s upload: %v", format, err)}
+	}
+	return r, bytes.HasPrefix(magic, zipMagic), nil
+}
+
+// readZip calls fn with each document in the zip archive r, named name,
+// decompressing any that are themselves gzip or bzip2 compressed. Documents
+// are named by their path in the archive, under name if it isn't empty.
+// Directories and macOS resource forks are skipped. Errors reading the
+// archive are *uploadErrors.
+func readZip(r io.Reader, name string, fn func(name string, doc io.Reader) error) error {
+	ra, size, cleanup, err := spool(r)
+	if err != nil {
+		return &uploadError{err}
+	}
+	defer cleanup()
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return &uploadError{err}
+	}
+
+	var files []*zip.File
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return &uploadError{errors.New("zip archive has no files")}
+	}
+	if len(files) > maxArchiveFiles {
+		return &uploadError{fmt.Errorf("zip archive has more than %d files", maxArchiveFiles)}
+	}
+
+	for _, f := range files {
+		rc, err := f.Open()
+		if err != nil {
+			return &uploadError{fmt.Errorf("%s: %v", f.Name, err)}
+		}
+		doc, err := decompress(rc)
+		if err == nil {
+			err = fn(path.Join(name, f.Name), doc)
+		} else {
+			err = &uploadError{fmt.Errorf("%s: %v", f.Name, err)}
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spoolUpload copies the upload r to w. Errors reading r, and uploads
+// larger than *maxUploadSize once decompressed, are *uploadErrors, so that
+// a small compressed upload can't fill the disk.
+func spoolUpload(w io.Writer, r io.Reader) (int64, error) {
+	ur := &uploadReader{r: io.LimitReader(r, *maxUploadSize+1)}
+	n, err := io.Copy(w, ur)
+	if ur.err != nil {
+		return n, &uploadError{ur.err}
+	}
+	if err != nil {
+		return n, err
+	}
+	if n > *maxUploadSize {
+		return n, &uploadError{fmt.Errorf("upload is larger than %d bytes uncompressed", *maxUploadSize)}
+	}
+	return n, nil
+}
+
+// spooledFile is a temporary copy of an upload, removed when it is closed.
+type spooledFile struct {
+	*os.File
+}
+
+// spoolTemp copies the upload r to a spooledFile, ready to be read from the
+// start. Errors are as spoolUpload's.
+func spoolTemp(r io.Reader) (*spooledFile, int64, error) {
+	f, err := ioutil.TempFile("", "coverage-validator-upload-")
+	if err != nil {
+		return nil, 0, err
+	}
+	sf := &spooledFile{f}
+	n, err := spoolUpload(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sf.Close()
+		return nil, 0, err
+	}
+	return sf, n, nil
+}
+
+func (f *spooledFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// uploadReader keeps the error reading r, to tell it apart from errors
+// writing it.
+type uploadReader struct {
+	r   io.Reader
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+// spool returns r as an io.ReaderAt, with its size, copying it to a
+// temporary file unless it is already a string or file. cleanup removes
+// any temporary file.
+func spool(r io.Reader) (ra io.ReaderAt, size int64, cleanup func(), err error) {
+	switch r := r.(type) {
+	case *strings.Reader:
+		return r, r.Size(), func() {}, nil
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return r, fi.Size(), func() {}, nil
+	}
+
+	f, err := ioutil.TempFile("", "coverage-validator-zip-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if size, err = spoolUpload(f, r); err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, size, cleanup, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// maxIndexSize bounds how much of an index.json we are willing to buffer.
+const maxIndexSize = 10 << 20
+
+// indexDoc is the subset of an issuer's index.json the crawler follows.
+type indexDoc struct {
+	ProviderURLs  []string `json:"provider_urls"`
+	FormularyURLs []string `json:"formulary_urls"`
+	PlanURLs      []string `json:"plan_urls"`
+}
+
+// URLResponse is the validation result for a single crawled document.
+type URLResponse struct {
+	URL string `json:"url"`
+	api.ValidationResponse
+}
+
+// CrawlResponse aggregates the results of validating an index.json and
+// every document it lists.
+type CrawlResponse struct {
+	Valid bool          `json:"valid"`
+	Index URLResponse   `json:"index"`
+	Files []URLResponse `json:"files"`
+}
+
+// namedResponses lists the index and file responses named by their URLs.
+func (resp CrawlResponse) namedResponses() []namedResponse {
+	resps := []namedResponse{{Name: resp.Index.URL, ValidationResponse: resp.Index.ValidationResponse}}
+	for _, file := range resp.Files {
+		resps = append(resps, namedResponse{Name: file.URL, ValidationResponse: file.ValidationResponse})
+	}
+	return resps
+}
+
+// Crawler validates an issuer's whole index.json tree.
+type Crawler struct {
+	Validator Validator
+	// Client fetches documents; if nil, publicClient is used.
+	Client *http.Client
+}
+
+// crawlTimeout bounds each fetch, including reading the document.
+const crawlTimeout = 5 * time.Minute
+
+// publicClient only fetches from public addresses, so that /crawl can't be
+// used to reach hosts on the server's own network or cloud metadata
+// services. It dials the addresses it checked, so a host can't resolve to
+// a public address for the check and a private one for the request.
+var publicClient = &http.Client{
+	Timeout: crawlTimeout,
+	Transport: &http.Transport{
+		DialContext:           dialPublic,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkCrawlScheme(req.URL)
+	},
+}
+
+// privateNetworks are the address ranges publicClient refuses to dial,
+// besides loopback, link-local, multicast and unspecified addresses.
+var privateNetworks = parseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic dials the first public address addr's host resolves to, and
+// refuses hosts with none.
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	for _, ip := range ips {
+		if publicIP(ip) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("%s is not a public address", host)
+}
+
+// checkCrawlScheme refuses to fetch anything but http and https URLs.
+func checkCrawlScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("cannot fetch %s: only http and https URLs can be crawled", u)
+	}
+	return nil
+}
+
+// Crawl fetches the index.json at indexURL, validates it, then fetches and
+// validates every provider, formulary and plan URL it lists against the
+// matching schema, listing at most maxErrors errors per file. Relative URLs
+// in the index are resolved against indexURL. Fetch failures are reported
+// as errors on the affected URL rather than aborting the crawl.
+func (c *Crawler) Crawl(ctx context.Context, indexURL string, year, maxErrors int) CrawlResponse {
+	var resp CrawlResponse
+	schemaYear := coverage.Year2SchemaYear(year)
+
+	base, err := url.Parse(indexURL)
+	if err != nil {
+		resp.Index = errorURLResponse(indexURL, "index", schemaYear, maxErrors, err)
+		return resp
+	}
+
+	body, err := c.get(ctx, indexURL)
+	if err != nil {
+		resp.Index = errorURLResponse(indexURL, "index", schemaYear, maxErrors, err)
+		return resp
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxIndexSize))
+	body.Close()
+	if err != nil {
+		resp.Index = errorURLResponse(indexURL, "index", schemaYear, maxErrors, err)
+		return resp
+	}
+	resp.Index = c.validate(indexURL, "index", schemaYear, maxErrors, bytes.NewReader(buf))
+	if !resp.Index.Valid {
+		return resp
+	}
+	var doc indexDoc
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		resp.Index = errorURLResponse(indexURL, "index", schemaYear, maxErrors, err)
+		return resp
+	}
+
+	resp.Valid = true
+	resp.Files = []URLResponse{}
+	plans := NewPlanIndex()
+	for _, list := range []struct {
+		schema string
+		urls   []string
+	}{
+		// plans come first so the index is complete before it is checked
+		{"plans", doc.PlanURLs},
+		{"providers", doc.ProviderURLs},
+		{"drugs", doc.FormularyURLs},
+	} {
+		for _, u := range list.urls {
+			file := c.crawlFile(ctx, base, u, list.schema, schemaYear, maxErrors, plans)
+			if !file.Valid {
+				resp.Valid = false
+			}
+			resp.Files = append(resp.Files, file)
+		}
+	}
+	return resp
+}
+
+// xrefSkipped warns that a file's plan references weren't checked.
+const xrefSkipped = "plan references weren't checked, as a plans file couldn't be read"
+
+// crawlFile fetches and validates a single file listed in the index. Plans
+// files are added to plans as they stream past, and providers and drugs
+// files are checked against it, unless a plans file couldn't be read.
+func (c *Crawler) crawlFile(ctx context.Context, base *url.URL, rawurl, schemaName string, schemaYear, maxErrors int, plans *PlanIndex) URLResponse {
+	ref, err := base.Parse(rawurl)
+	if err != nil {
+		if schemaName == "plans" {
+			plans.incomplete = true
+		}
+		return errorURLResponse(rawurl, schemaName, schemaYear, maxErrors, err)
+	}
+	body, err := c.get(ctx, ref.String())
+	if err != nil {
+		if schemaName == "plans" {
+			plans.incomplete = true
+		}
+		return errorURLResponse(ref.String(), schemaName, schemaYear, maxErrors, err)
+	}
+	defer body.Close()
+
+	var check func(io.Reader) core.ValidationResult
+	switch {
+	case schemaName == "plans":
+		check = func(r io.Reader) core.ValidationResult {
+			// malformed plans are reported by the schema validator
+			if err := plans.Add(r); err != nil {
+				plans.incomplete = true
+			}
+			return core.ValidationResult{}
+		}
+	case plans.incomplete:
+		// every reference to the plans that weren't read would be reported
+		check = func(io.Reader) core.ValidationResult {
+			return core.ValidationResult{Warnings: []core.Warning{fixedWarning(xrefSkipped)}}
+		}
+	case schemaName == "providers":
+		check = func(r io.Reader) core.ValidationResult {
+			return plans.CheckProviders(r, *maxErrorsCeiling)
+		}
+	case schemaName == "drugs":
+		check = func(r io.Reader) core.ValidationResult {
+			return plans.CheckDrugs(r, *maxErrorsCeiling)
+		}
+	}
+
+	resp := URLResponse{URL: ref.String()}
+	resp.Schema = schemaName
+	resp.SchemaYear = schemaYear
+	resp.MaxErrors = maxErrors
+	result, records := locatedValidate(body, func(r io.Reader) core.ValidationResult {
+		return c.Validator.validateFor(&resp.ValidationResponse, r, nil)
+	}, check, nil)
+	renderWarningsErrors(&resp.ValidationResponse, &result)
+	locateFindings(resp.Findings, records, nil)
+	return resp
+}
+
+// get issues a GET for rawurl and returns the body of a 200 response.
+func (c *Crawler) get(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCrawlScheme(req.URL); err != nil {
+		return nil, err
+	}
+	client := c.Client
+	if client == nil {
+		client = publicClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", rawurl, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (c *Crawler) validate(rawurl, schemaName string, schemaYear, maxErrors int, r io.Reader) URLResponse {
+	resp := URLResponse{URL: rawurl}
+	resp.Schema = schemaName
+	resp.SchemaYear = schemaYear
+	resp.MaxErrors = maxErrors
+	result := c.Validator.validateFor(&resp.ValidationResponse, r, nil)
+	renderWarningsErrors(&resp.ValidationResponse, &result)
+	return resp
+}
+
+func errorURLResponse(rawurl, schemaName string, schemaYear, maxErrors int, err error) URLResponse {
+	resp := URLResponse{URL: rawurl}
+	resp.Schema = schemaName
+	resp.SchemaYear = schemaYear
+	resp.MaxErrors = maxErrors
+	result := coverage.NewValidationErrorResult(err)
+	renderWarningsErrors(&resp.ValidationResponse, &result)
+	return resp
+}
+
+// ServeHTTP handles POSTs to /crawl with "url", "schemaYear" and optional
+// "maxErrors" form fields.
+func (c *Crawler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	if _, err := c.Validator.parseYear("index", r.FormValue("schemaYear")); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	year, _ := strconv.Atoi(r.FormValue("schemaYear"))
+	resp := c.Crawl(r.Context(), r.FormValue("url"), year, parseMaxErrors(r.FormValue("maxErrors")))
+	format := responseFormat(r.FormValue("format"), r.Header.Get("Accept"))
+	if serveReport(w, format, r.FormValue("download") != "", resp.namedResponses()) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
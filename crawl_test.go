@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func testCrawler(t *testing.T) *Crawler {
+	if logger == nil {
+		logger = &log.Logger{Out: os.Stderr, Formatter: &log.TextFormatter{}, Level: log.ErrorLevel}
+	}
+	v := NewValidator()
+	for _, s := range []struct {
+		name, filename string
+	}{
+		{"plans", "plans_schema.json"},
+		{"providers", "providers_schema.json"},
+		{"drugs", "drugs_schema.json"},
+		{"index", "index_schema.json"},
+	} {
+		if err := v.addFile(s.name, 0, s.filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the test server is on loopback, which publicClient refuses
+	return &Crawler{Validator: v, Client: http.DefaultClient}
+}
+
+// issuerServer stands in for an issuer's site, with an index listing a
+// plans file, a missing providers file and an empty formulary.
+func issuerServer() *httptest.Server {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/index.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"plan_urls": ["` + srv.URL + `/plans.json"],
+			"provider_urls": ["` + srv.URL + `/missing.json"],
+			"formulary_urls": ["` + srv.URL + `/drugs.json"]
+		}`))
+	})
+	mux.HandleFunc("/plans.json", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/plans.json")
+	})
+	mux.HandleFunc("/drugs.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestCrawl(t *testing.T) {
+	srv := issuerServer()
+	defer srv.Close()
+
+	resp := testCrawler(t).Crawl(context.Background(), srv.URL+"/index.json", 2017, 10)
+	if !resp.Index.Valid {
+		t.Fatalf("index invalid: %v", resp.Index.Errors)
+	}
+	if resp.Valid {
+		t.Error("crawl with a missing file is valid")
+	}
+
+	want := []struct {
+		url, schema string
+	}{
+		{srv.URL + "/plans.json", "plans"},
+		{srv.URL + "/missing.json", "providers"},
+		{srv.URL + "/drugs.json", "drugs"},
+	}
+	if len(resp.Files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(resp.Files), len(want))
+	}
+	for i, w := range want {
+		file := resp.Files[i]
+		if file.URL != w.url || file.Schema != w.schema {
+			t.Errorf("file %d is %s as %s, want %s as %s", i, file.URL, file.Schema, w.url, w.schema)
+		}
+		fetchFailed := false
+		for _, err := range file.Errors {
+			if strings.Contains(err, "404") {
+				fetchFailed = true
+			}
+		}
+		if missing := w.url == srv.URL+"/missing.json"; fetchFailed != missing {
+			t.Errorf("%s: fetch failed is %v, want %v: %v", w.url, fetchFailed, missing, file.Errors)
+		}
+	}
+}
+
+func TestCrawlRefusesPrivateURLs(t *testing.T) {
+	srv := issuerServer()
+	defer srv.Close()
+
+	c := testCrawler(t)
+	c.Client = nil
+	for _, indexURL := range []string{srv.URL + "/index.json", "file:///etc/passwd"} {
+		resp := c.Crawl(context.Background(), indexURL, 2017, 10)
+		if resp.Index.Valid || len(resp.Files) != 0 {
+			t.Errorf("crawled %s", indexURL)
+		}
+	}
+}
+
+func TestCrawlSkipsPlanReferencesWithoutPlans(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	var planURLs string
+	mux.HandleFunc("/index.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"plan_urls": [` + planURLs + `],
+			"provider_urls": ["` + srv.URL + `/providers.json"],
+			"formulary_urls": []
+		}`))
+	})
+	mux.HandleFunc("/plans.json", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/plans.json")
+	})
+	mux.HandleFunc("/providers.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"npi": "1234567893", "plans": [
+			{"plan_id": "12345XX9876543"},
+			{"plan_id": "99999XX9999999"}
+		]}]`))
+	})
+
+	for _, test := range []struct {
+		planURLs string
+		notFound bool
+	}{
+		{`"` + srv.URL + `/plans.json"`, true},
+		{`"` + srv.URL + `/plans.json", "` + srv.URL + `/missing.json"`, false},
+	} {
+		planURLs = test.planURLs
+		resp := testCrawler(t).Crawl(context.Background(), srv.URL+"/index.json", 2017, 100)
+		providers := resp.Files[len(resp.Files)-1]
+		notFound := false
+		for _, err := range providers.Errors {
+			notFound = notFound || strings.Contains(err, xrefPlanNotFound)
+		}
+		skipped := false
+		for _, warning := range providers.Warnings {
+			skipped = skipped || strings.Contains(warning, xrefSkipped)
+		}
+		if notFound != test.notFound || skipped == test.notFound {
+			t.Errorf("plans %s: plan not found is %v and skipped is %v, want %v and %v", test.planURLs, notFound, skipped, test.notFound, !test.notFound)
+		}
+	}
+}
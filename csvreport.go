@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// recordNPIs returns the npi of each providers record that findings belong
+// to, read back from src.
+func recordNPIs(findings []api.Finding, src io.ReadSeeker) map[int]string {
+	npis := make(map[int]string)
+	for _, f := range findings {
+		if f.RecordPosition == nil {
+			continue
+		}
+		if _, ok := npis[f.Record]; ok {
+			continue
+		}
+		if _, err := src.Seek(f.RecordPosition.Offset, io.SeekStart); err != nil {
+			continue
+		}
+		var record struct {
+			NPI string `json:"npi"`
+		}
+		// malformed records are the validators' business
+		json.NewDecoder(src).Decode(&record)
+		npis[f.Record] = record.NPI
+	}
+	return npis
+}
+
+// findingNPI returns the NPI of the record f belongs to, if known.
+func findingNPI(resp namedResponse, f api.Finding) string {
+	if npi, ok := resp.NPIs[f.Record]; ok {
+		return npi
+	}
+	// findings about the npi itself carry it as their value
+	if s, ok := f.Value.(string); ok && strings.HasSuffix(f.Path, ".npi") {
+		return s
+	}
+	return ""
+}
+
+// writeCSV writes a row per listed finding, with an npi column if any of
+// resps is for a providers file.
+func writeCSV(w io.Writer, resps []namedResponse) error {
+	header := []string{"file", "severity", "record", "path", "rule", "message", "value"}
+	providers := false
+	for _, resp := range resps {
+		providers = providers || resp.Schema == "providers"
+	}
+	if providers {
+		header = append(header, "npi")
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, resp := range resps {
+		for _, f := range resp.Findings {
+			row := []string{csvCell(resp.Name), f.Severity, "", "", f.Rule, f.Description, csvCell(csvValue(f.Value))}
+			if f.Record >= 0 {
+				row[2] = strconv.Itoa(f.Record)
+			}
+			if f.Path != "" {
+				row[3] = jsonPath(f.Path)
+			}
+			if providers {
+				row = append(row, csvCell(findingNPI(resp, f)))
+			}
+			cw.Write(row)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell quotes s with a leading ' if it starts with a character that
+// would make a spreadsheet read it as a formula. Cells that come from the
+// uploaded document go through it.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// csvValue formats a finding's value for a CSV cell: strings as they are,
+// anything else as JSON.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
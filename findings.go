@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/adhocteam/qhpvalidator/api"
+	js "github.com/xeipuuv/gojsonschema"
+)
+
+// schemaRules maps gojsonschema's error message formats, and our own that
+// follow the same shape, back to the rule that produced them.
+var schemaRules = []struct {
+	rule   string
+	format string
+}{
+	{"required", js.ERROR_MESSAGE_X_IS_MISSING_AND_REQUIRED},
+	{"type", js.ERROR_MESSAGE_X_MUST_BE_OF_TYPE_Y},
+	{"type", js.ERROR_MESSAGE_MUST_BE_OF_TYPE_X},
+	{"uniqueItems", js.ERROR_MESSAGE_X_ITEMS_MUST_BE_UNIQUE},
+	{"pattern", js.ERROR_MESSAGE_DOES_NOT_MATCH_PATTERN},
+	{"format", js.ERROR_MESSAGE_DOES_NOT_MATCH_FORMAT},
+	{"enum", js.ERROR_MESSAGE_MUST_MATCH_ONE_ENUM_VALUES},
+	{"minLength", js.ERROR_MESSAGE_STRING_LENGTH_MUST_BE_GREATER_OR_EQUAL},
+	{"maxLength", js.ERROR_MESSAGE_STRING_LENGTH_MUST_BE_LOWER_OR_EQUAL},
+	{"maximum", js.ERROR_MESSAGE_NUMBER_MUST_BE_LOWER_OR_EQUAL},
+	{"maximum", js.ERROR_MESSAGE_NUMBER_MUST_BE_LOWER},
+	{"minimum", js.ERROR_MESSAGE_NUMBER_MUST_BE_GREATER_OR_EQUAL},
+	{"minimum", js.ERROR_MESSAGE_NUMBER_MUST_BE_GREATER},
+	{"allOf", js.ERROR_MESSAGE_NUMBER_MUST_VALIDATE_ALLOF},
+	{"oneOf", js.ERROR_MESSAGE_NUMBER_MUST_VALIDATE_ONEOF},
+	{"anyOf", js.ERROR_MESSAGE_NUMBER_MUST_VALIDATE_ANYOF},
+	{"not", js.ERROR_MESSAGE_NUMBER_MUST_VALIDATE_NOT},
+	{"minItems", js.ERROR_MESSAGE_ARRAY_MIN_ITEMS},
+	{"maxItems", js.ERROR_MESSAGE_ARRAY_MAX_ITEMS},
+	{"minProperties", js.ERROR_MESSAGE_ARRAY_MIN_PROPERTIES},
+	{"maxProperties", js.ERROR_MESSAGE_ARRAY_MAX_PROPERTIES},
+	{"dependencies", js.ERROR_MESSAGE_HAS_DEPENDENCY_ON},
+	{"multipleOf", js.ERROR_MESSAGE_MULTIPLE_OF},
+	{"additionalItems", js.ERROR_MESSAGE_ARRAY_NO_ADDITIONAL_ITEM},
+	{"additionalProperties", js.ERROR_MESSAGE_ADDITIONAL_PROPERTY_NOT_ALLOWED},
+	{"patternProperties", js.ERROR_MESSAGE_INVALID_PATTERN_PROPERTY},
+	{"planReference", xrefPlanNotFound},
+	{"networkTierReference", xrefNetworkTierNotFound},
+	{"drugTierReference", xrefDrugTierNotFound},
+	{"npiChecksum", npiInvalidChecksum},
+	{"npiNotFound", npiNotFound},
+	{"npiDeactivated", npiDeactivated},
+	{"npiEntityTypeMismatch", npiEntityTypeMismatch},
+}
+
+var schemaRuleRegexps = make([]*regexp.Regexp, len(schemaRules))
+
+func init() {
+	verb := regexp.MustCompile(`%[sd]`)
+	for i, r := range schemaRules {
+		parts := verb.Split(r.format, -1)
+		for j := range parts {
+			parts[j] = regexp.QuoteMeta(parts[j])
+		}
+		schemaRuleRegexps[i] = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	}
+}
+
+// newFinding parses a validation message into a Finding. Messages produced
+// by gojsonschema follow its RESULT_ERROR_FORMAT ("context : description,
+// given value"); anything else is kept whole in Message.
+func newFinding(severity, msg string) api.Finding {
+	f := api.Finding{
+		Severity:    severity,
+		Record:      -1,
+		Message:     msg,
+		Description: msg,
+	}
+
+	sep := strings.Index(msg, " : ")
+	if sep < 0 || !strings.HasPrefix(msg, js.STRING_CONTEXT_ROOT) {
+		return f
+	}
+	f.Path = msg[:sep]
+	f.Record = recordIndex(f.Path)
+
+	desc := msg[sep+len(" : "):]
+	if given := strings.LastIndex(desc, ", given "); given >= 0 {
+		raw := desc[given+len(", given "):]
+		if err := json.Unmarshal([]byte(raw), &f.Value); err != nil {
+			f.Value = raw
+		}
+		desc = desc[:given]
+	}
+	f.Description = desc
+	f.Rule = schemaRule(desc)
+	return f
+}
+
+// recordIndex returns the top-level array index in a gojsonschema context
+// like "(root).3.plans.0.plan_id", or -1 if there isn't one.
+func recordIndex(path string) int {
+	parts := strings.SplitN(path, ".", 3)
+	if len(parts) < 2 {
+		return -1
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+func schemaRule(desc string) string {
+	for i, re := range schemaRuleRegexps {
+		if re.MatchString(desc) {
+			return schemaRules[i].rule
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// maxSnippet bounds how much of a record an HTML report quotes.
+const maxSnippet = 2 << 10
+
+// recordSnippets returns the text of each record that findings belong to,
+// read back from src, indented if it is short enough to quote whole.
+func recordSnippets(findings []api.Finding, src io.ReadSeeker) map[int]string {
+	snippets := make(map[int]string)
+	for _, f := range findings {
+		if f.RecordPosition == nil {
+			continue
+		}
+		if _, ok := snippets[f.Record]; ok {
+			continue
+		}
+		if s, ok := readValue(src, *f.RecordPosition); ok {
+			snippets[f.Record] = s
+		}
+	}
+	return snippets
+}
+
+// readValue returns the JSON value starting at start, cut short after
+// maxSnippet bytes.
+func readValue(src io.ReadSeeker, start api.Position) (string, bool) {
+	if _, err := src.Seek(start.Offset, io.SeekStart); err != nil {
+		return "", false
+	}
+	var buf bytes.Buffer
+	s := newJSONScanner(io.TeeReader(io.LimitReader(src, maxSnippet), &buf), start, 0)
+	s.scan(func(api.Position) bool { return false })
+
+	// the scanner reads ahead, so trim to where it stopped
+	raw := buf.Bytes()
+	if n := int(s.pos.Offset - start.Offset); n < len(raw) {
+		raw = raw[:n]
+	}
+	if len(raw) >= maxSnippet {
+		return string(raw) + "…", true
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, bytes.TrimSpace(raw), "", "  "); err != nil {
+		return string(bytes.TrimSpace(raw)), true
+	}
+	return indented.String(), true
+}
+
+type htmlReport struct {
+	Generated time.Time
+	Files     []htmlReportFile
+}
+
+type htmlReportFile struct {
+	namedResponse
+	Errors   []htmlGroup
+	Warnings []htmlGroup
+}
+
+// htmlGroup is a summary group with the findings in it that were listed.
+type htmlGroup struct {
+	api.RuleSummary
+	Findings []htmlFinding
+	// More counts the group's findings that were left out.
+	More int
+}
+
+type htmlFinding struct {
+	api.Finding
+	Location string
+	Snippet  string
+}
+
+// writeHTML writes a self-contained HTML report, with no external styles
+// or scripts, so that it can be saved and sent on as a single file.
+func writeHTML(w io.Writer, resps []namedResponse) error {
+	report := htmlReport{Generated: time.Now()}
+	for _, resp := range resps {
+		file := htmlReportFile{namedResponse: resp}
+		for _, s := range resp.Summary {
+			g := htmlGroup{RuleSummary: s}
+			for _, f := range groupFindings(resp.Findings, s) {
+				g.Findings = append(g.Findings, htmlFinding{
+					Finding:  f,
+					Location: findingLocation(f),
+					Snippet:  resp.Snippets[f.Record],
+				})
+			}
+			g.More = s.Count - len(g.Findings)
+			if s.Severity == api.SeverityError {
+				file.Errors = append(file.Errors, g)
+			} else {
+				file.Warnings = append(file.Warnings, g)
+			}
+		}
+		report.Files = append(report.Files, file)
+	}
+	return htmlReportTemplate.Execute(w, report)
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Validation report</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; color: #222; margin: 2em auto; max-width: 60em; padding: 0 1em; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 1.3em; border-bottom: 1px solid #ccc; padding-bottom: .3em; margin-top: 2em; }
+h3 { font-size: 1.1em; }
+.status { display: inline-block; padding: .2em .6em; border-radius: .3em; color: #fff; font-weight: bold; }
+.valid { background: #2e7d32; }
+.invalid { background: #c62828; }
+.note { color: #666; }
+table { border-collapse: collapse; width: 100%; margin: 1em 0; }
+th, td { text-align: left; padding: .3em .6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f5f5f5; }
+td.count { text-align: right; }
+.group { margin: 1em 0; padding: .5em 1em; border-left: 4px solid #c62828; background: #fafafa; }
+.group.warning { border-left-color: #f9a825; }
+.group ul { padding-left: 1.2em; }
+code, pre { font-family: Menlo, Consolas, monospace; font-size: .9em; }
+pre { background: #f0f0f0; padding: .5em; overflow: auto; max-height: 20em; }
+</style>
+</head>
+<body>
+<h1>Validation report</h1>
+<p class="note">Generated {{.Generated.Format "January 2, 2006 at 3:04 PM MST"}}</p>
+{{range .Files}}
+<h2>{{.Name}}</h2>
+<p>
+{{if .Valid}}<span class="status valid">Valid</span>{{else}}<span class="status invalid">Invalid</span>{{end}}
+{{.Schema}} schema{{if .SchemaYear}}, {{.SchemaYear}}{{end}}:
+{{len .Errors}} kinds of error, {{len .Warnings}} kinds of warning.
+</p>
+{{if .Truncated}}<p class="note">Not every error is listed{{if .SuppressedErrors}}; {{.SuppressedErrors}} were left out{{end}}. The counts below include them.</p>{{end}}
+{{if eq .NPIVerification "checksum_only"}}<p class="note">NPIs were only checked for valid check digits, not looked up.</p>{{end}}
+
+{{if .Summary}}
+<h3>Summary</h3>
+<table>
+<tr><th>Severity</th><th>Rule</th><th>Path</th><th>Message</th><th>Count</th><th>Example records</th></tr>
+{{range .Summary}}<tr><td>{{.Severity}}</td><td>{{.Rule}}</td><td><code>{{.Path}}</code></td><td>{{.Message}}</td><td class="count">{{.Count}}</td><td>{{range $i, $r := .Records}}{{if $i}}, {{end}}{{$r}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{if .Errors}}<h3>Errors</h3>{{template "groups" .Errors}}{{end}}
+{{if .Warnings}}<h3>Warnings</h3>{{template "groups" .Warnings}}{{end}}
+{{end}}
+</body>
+</html>
+{{define "groups"}}{{range .}}
+<div class="group {{.Severity}}">
+<p><strong>{{.Message}}</strong>{{if .Path}} at <code>{{.Path}}</code>{{end}} ({{.Count}})</p>
+<ul>
+{{range .Findings}}<li>{{if ge .Record 0}}Record {{.Record}}: {{end}}{{.Location}}<code>{{.Message}}</code>
+{{if .Snippet}}<pre>{{.Snippet}}</pre>{{end}}</li>
+{{end}}{{if .More}}<li class="note">and {{.More}} more</li>{{end}}
+</ul>
+</div>
+{{end}}{{end}}
+`))
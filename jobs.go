@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// Job is an asynchronous validation of an uploaded document. The upload is
+// spooled to a temporary file so that the POST can return as soon as it has
+// been received.
+type Job struct {
+	api.Job
+	path string
+}
+
+// JobQueue runs validation jobs on a fixed pool of workers and keeps their
+// results until they are deleted.
+type JobQueue struct {
+	validator Validator
+	queue     chan *Job
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobQueue starts workers goroutines validating jobs against v. Up to
+// backlog jobs may wait for a worker before new submissions are refused.
+func NewJobQueue(v Validator, workers, backlog int) *JobQueue {
+	q := &JobQueue{
+		validator: v,
+		queue:     make(chan *Job, backlog),
+		jobs:      make(map[string]*Job),
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+var ErrQueueFull = errors.New("validator: job queue is full")
+
+// Submit spools doc to disk and queues it for validation. A doc larger than
+// -max-upload-size is an *uploadError.
+func (q *JobQueue) Submit(schemaName string, schemaYear, maxErrors int, doc io.Reader) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "coverage-validator-job-")
+	if err != nil {
+		return nil, err
+	}
+	n, err := spoolUpload(f, doc)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	job := &Job{
+		Job: api.Job{
+			ID:         id,
+			State:      api.JobQueued,
+			Schema:     schemaName,
+			SchemaYear: schemaYear,
+			MaxErrors:  maxErrors,
+			Created:    time.Now(),
+			BytesTotal: n,
+		},
+		path: f.Name(),
+	}
+	q.mu.Lock()
+	q.jobs[id] = job
+	q.mu.Unlock()
+
+	select {
+	case q.queue <- job:
+		return job, nil
+	default:
+		q.Delete(id)
+		return nil, ErrQueueFull
+	}
+}
+
+// Get returns a snapshot of the job with the given ID.
+func (q *JobQueue) Get(id string) (api.Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return api.Job{}, false
+	}
+	return api.Job{
+		ID:               job.ID,
+		State:            job.State,
+		Schema:           job.Schema,
+		SchemaYear:       job.SchemaYear,
+		MaxErrors:        job.MaxErrors,
+		Created:          job.Created,
+		RecordsProcessed: atomic.LoadInt64(&job.RecordsProcessed),
+		BytesRead:        atomic.LoadInt64(&job.BytesRead),
+		BytesTotal:       job.BytesTotal,
+		Result:           job.Result,
+	}, true
+}
+
+// Delete expires a job. A queued job is dropped without running; a running
+// job finishes but its result is discarded.
+func (q *JobQueue) Delete(id string) bool {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	queued := ok && job.State == api.JobQueued
+	delete(q.jobs, id)
+	q.mu.Unlock()
+	if queued {
+		os.Remove(job.path)
+	}
+	return ok
+}
+
+func (q *JobQueue) work() {
+	for job := range q.queue {
+		q.mu.Lock()
+		_, ok := q.jobs[job.ID]
+		if ok {
+			job.State = api.JobRunning
+		}
+		q.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		resp := q.run(job)
+
+		q.mu.Lock()
+		job.State = api.JobDone
+		job.Result = &resp
+		q.mu.Unlock()
+	}
+}
+
+func (q *JobQueue) run(job *Job) api.ValidationResponse {
+	defer os.Remove(job.path)
+
+	resp := api.ValidationResponse{Schema: job.Schema, SchemaYear: job.SchemaYear, MaxErrors: job.MaxErrors}
+	f, err := os.Open(job.path)
+	if err != nil {
+		result := coverage.NewValidationErrorResult(err)
+		renderWarningsErrors(&resp, &result)
+		return resp
+	}
+	defer f.Close()
+
+	r := &countingReader{r: f, n: &job.BytesRead}
+	result, records := q.validator.validateLocated(&resp, r, &job.RecordsProcessed, nil)
+	renderWarningsErrors(&resp, &result)
+	locateFindings(resp.Findings, records, f)
+	return resp
+}
+
+// countingReader atomically adds the number of bytes read to n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ServeHTTP handles the job API:
+//
+//	POST   /jobs       submit a document, with the same fields as /validate
+//	GET    /jobs/{id}  job state, progress and, once done, the result
+//	DELETE /jobs/{id}  expire a job
+func (q *JobQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+
+	switch {
+	case id == "" && r.Method == "POST":
+		q.serveSubmit(w, r)
+	case id != "" && r.Method == "GET":
+		job, ok := q.Get(id)
+		if !ok {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			http.Error(w, http.StatusText(500), 500)
+		}
+	case id != "" && r.Method == "DELETE":
+		if !q.Delete(id) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(405), 405)
+	}
+}
+
+func (q *JobQueue) serveSubmit(w http.ResponseWriter, r *http.Request) {
+	job, err := q.submitForm(r)
+	switch err.(type) {
+	case *yearError, *uploadError:
+		writeBadRequest(w, err)
+		return
+	}
+	switch {
+	case err == ErrQueueFull:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		logger.Errorf("error submitting validation job: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	case job == nil:
+		http.Error(w, "missing json field", 400)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	snapshot, _ := q.Get(job.ID)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		logger.Errorf("error writing job %s: %v", job.ID, err)
+	}
+}
+
+// submitForm submits the document in a /validate style form. It returns a
+// nil Job if the form has no json field.
+func (q *JobQueue) submitForm(r *http.Request) (*Job, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		schemaYear, err := q.validator.parseYear(r.FormValue("schema"), r.FormValue("schemaYear"))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := r.Form["json"]; !ok {
+			return nil, nil
+		}
+		return q.Submit(r.FormValue("schema"), schemaYear, parseMaxErrors(r.FormValue("maxErrors")), strings.NewReader(r.FormValue("json")))
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, &uploadError{err}
+	}
+	var (
+		schemaName string
+		year       string
+		maxErrors  = parseMaxErrors("")
+	)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &uploadError{err}
+		}
+		switch part.FormName() {
+		case "schemaYear":
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return nil, &uploadError{fmt.Errorf("reading schemaYear: %v", err)}
+			}
+			year = string(buff)
+		case "schema":
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return nil, &uploadError{fmt.Errorf("reading schema: %v", err)}
+			}
+			schemaName = string(buff)
+		case "maxErrors":
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return nil, &uploadError{fmt.Errorf("reading maxErrors: %v", err)}
+			}
+			maxErrors = parseMaxErrors(string(buff))
+		case "json":
+			schemaYear, err := q.validator.parseYear(schemaName, year)
+			if err != nil {
+				return nil, err
+			}
+			doc, isZip, err := openUpload(part, part.FileName(), part.Header.Get("Content-Encoding"))
+			if err == nil && isZip {
+				err = &uploadError{errors.New("zip archives can't be validated as jobs")}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return q.Submit(schemaName, schemaYear, maxErrors, doc)
+		}
+	}
+}
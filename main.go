@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,71 +11,40 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
 	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+	"github.com/adhocteam/qhpvalidator/api"
 
 	log "github.com/Sirupsen/logrus"
 	js "github.com/xeipuuv/gojsonschema"
 )
 
 var (
-	logger    *log.Logger
-	npiLookup *coverage.InMemoryNPILookup
-	npiFile   = flag.String("d", "npis.csv", "path to NPI file")
-	hasHeader = flag.Bool("r", true, "whether NPI file has a CSV header row")
+	logger     *log.Logger
+	npiFile    = flag.String("d", "npis.csv", "path to NPI file")
+	hasHeader  = flag.Bool("r", true, "whether NPI file has a CSV header row")
+	noNPIs     = flag.Bool("no-npis", false, "run without NPI data, only checking NPI check digits")
+	npiDetails = flag.Bool("npi-details", false, "keep NPI names and deactivation dates, if the NPI file is from NPPES")
+	adminToken = flag.String("admin-token", "", "bearer token for the /admin endpoints, which are disabled if empty")
+
+	plansSchema     = flag.String("plans", "plans_schema.json", "plans JSON schema")
+	providersSchema = flag.String("providers", "providers_schema.json", "providers JSON schema")
+	drugsSchema     = flag.String("drugs", "drugs_schema.json", "drugs JSON schema")
+	indexSchema     = flag.String("index", "index_schema.json", "index JSON schema")
+	schemaDir       = flag.String("schemas", "schemas", "directory of per-year schemas, laid out as <dir>/<year>/<name>.json")
+
+	maxUploadSize    = flag.Int64("max-upload-size", 1<<30, "largest document, in bytes once decompressed, spooled to disk for a job or streamed response")
+	maxSchemaSize    = flag.Int64("max-schema-size", 32<<20, "largest document, in bytes, read into memory to check against a registered JSON schema")
+	maxErrorsCeiling = flag.Int("max-errors-ceiling", 5000, "most errors collected for any one document, whatever the request asks for")
+
+	jobWorkers = flag.Int("workers", 2, "number of workers running async validation jobs")
+	jobBacklog = flag.Int("backlog", 100, "number of async validation jobs that may wait for a worker")
 )
 
-func loadNPIs() error {
-	file, err := os.Open(*npiFile)
-	if err != nil {
-		return fmt.Errorf("error opening NPI file: %s", *npiFile)
-	}
-	defer file.Close()
-
-	npiLookup = coverage.NewInMemoryNPILookup()
-	reader := csv.NewReader(file)
-	t0 := time.Now()
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading NPI file: %v", err)
-		}
-
-		if *hasHeader {
-			*hasHeader = false
-			continue
-		}
-
-		npi, err := strconv.Atoi(record[0])
-
-		if err != nil {
-			logger.Infof("error converting NPI string to int: %q", record[0])
-			return err
-		}
-
-		// some npis in the file do not have types associated with them
-		if record[1] != "" {
-			entity, err := strconv.Atoi(record[1])
-			if err != nil {
-				logger.Infof("error converting entity string to int: %q", record[1])
-				return err
-			}
-			npiLookup.NPIProviderType[npi] = entity
-		}
-	}
-
-	logger.Infof("loaded %d NPIs in %v", len(npiLookup.NPIProviderType), time.Now().Sub(t0))
-	return nil
-}
-
 func main() {
 	flag.Parse()
 
@@ -87,35 +54,31 @@ func main() {
 		Level:     log.InfoLevel,
 	}
 
-	if err := loadNPIs(); err != nil {
+	if *noNPIs {
+		logger.Warnf("running without NPI data; provider NPIs will only have their check digits verified")
+	} else if _, err := loadNPIs(); err != nil {
 		logger.Fatalf("error loading npis: %v", err)
 	}
+	reloadNPIsOnSIGHUP()
 
-	var (
-		plansSchema     = flag.String("plans", "plans_schema.json", "plans JSON schema")
-		providersSchema = flag.String("providers", "providers_schema.json", "providers JSON schema")
-		drugsSchema     = flag.String("drugs", "drugs_schema.json", "drugs JSON schema")
-		indexSchema     = flag.String("index", "index_schema.json", "index JSON schema")
-	)
-
-	validator := NewValidator()
+	validator, err := loadSchemas()
+	if err != nil {
+		logger.Fatalf("error loading schemas: %v", err)
+	}
 
-	for _, s := range []struct {
-		name, filename string
-	}{
-		{"plans", *plansSchema},
-		{"providers", *providersSchema},
-		{"drugs", *drugsSchema},
-		{"index", *indexSchema},
-	} {
-		f, err := os.Open(s.filename)
-		if err != nil {
-			log.Fatalf("opening %s schema from file %s: %v", s.name, s.filename, err)
-		}
-		if err := validator.Add(s.name, f); err != nil {
-			log.Fatalf("adding %s schema from file %s: %v", s.name, s.filename)
-		}
-		f.Close()
+	crawler := &Crawler{Validator: validator}
+
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(runValidate(validator, flag.Args()[1:]))
+	case "crawl":
+		// unlike /crawl, the command may fetch from the local network
+		crawler.Client = &http.Client{Timeout: crawlTimeout}
+		os.Exit(runCrawl(crawler, flag.Args()[1:]))
+	case "xref":
+		os.Exit(runXref(flag.Args()[1:]))
+	case "npi-index":
+		os.Exit(runNPIIndex(flag.Args()[1:]))
 	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -126,9 +89,28 @@ func main() {
 	})
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	http.Handle("/validate", validator)
+	http.HandleFunc("/schemas", validator.ServeSchemas)
+	http.Handle("/crawl", crawler)
+	jobs := NewJobQueue(validator, *jobWorkers, *jobBacklog)
+	http.Handle("/jobs", jobs)
+	http.Handle("/jobs/", jobs)
+	http.HandleFunc("/health", serveHealth)
+	if *adminToken != "" {
+		http.Handle("/admin/npis/reload", requireAdmin(http.HandlerFunc(serveNPIReload)))
+	}
 	http.HandleFunc("/schema/", func(w http.ResponseWriter, r *http.Request) {
+		// /schema/{name} or /schema/{year}/{name}
+		var year int
 		schemaName := r.URL.Path[len("/schema/"):]
-		validator.ServeFile(schemaName, w)
+		if i := strings.Index(schemaName, "/"); i >= 0 {
+			y, err := strconv.Atoi(schemaName[:i])
+			if err != nil {
+				http.Error(w, http.StatusText(404), 404)
+				return
+			}
+			year, schemaName = coverage.Year2SchemaYear(y), schemaName[i+1:]
+		}
+		validator.ServeFile(schemaName, year, w)
 	})
 
 	port := "8080"
@@ -145,7 +127,74 @@ func main() {
 	<-done
 }
 
-type Validator map[string]*schema
+// loadSchemas reads the JSON schema files named on the command line into a
+// new Validator as the defaults for every year, then adds any schemas found
+// in the schema directory: <dir>/<name>.json for every year, or
+// <dir>/<year>/<name>.json for a single year.
+func loadSchemas() (Validator, error) {
+	validator := NewValidator()
+
+	for _, s := range []struct {
+		name, filename string
+	}{
+		{"plans", *plansSchema},
+		{"providers", *providersSchema},
+		{"drugs", *drugsSchema},
+		{"index", *indexSchema},
+	} {
+		if err := validator.addFile(s.name, 0, s.filename); err != nil {
+			return nil, err
+		}
+	}
+
+	years, err := ioutil.ReadDir(*schemaDir)
+	if os.IsNotExist(err) {
+		return validator, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, y := range years {
+		// schemas at the top level apply to every year
+		if !y.IsDir() && filepath.Ext(y.Name()) == ".json" {
+			name := strings.TrimSuffix(y.Name(), ".json")
+			if err := validator.addFile(name, 0, filepath.Join(*schemaDir, y.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		year, err := strconv.Atoi(y.Name())
+		if !y.IsDir() || err != nil {
+			continue
+		}
+		dir := filepath.Join(*schemaDir, y.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+				continue
+			}
+			name := strings.TrimSuffix(f.Name(), ".json")
+			if err := validator.addFile(name, coverage.Year2SchemaYear(year), filepath.Join(dir, f.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return validator, nil
+}
+
+// schemaKey identifies a schema in a Validator. Year is a schema year as
+// returned by coverage.Year2SchemaYear; year 0 holds the default schema for
+// years that don't have their own.
+type schemaKey struct {
+	name string
+	year int
+}
+
+type Validator map[schemaKey]*schema
 
 type schema struct {
 	parsed   *js.Schema
@@ -156,9 +205,9 @@ func NewValidator() Validator {
 	return make(Validator)
 }
 
-// Add adds a schema by name to the internal registry. Note that it consumes
-// the passed-in io.Reader so callers should be aware.
-func (v Validator) Add(name string, r io.Reader) error {
+// Add adds a schema by name and schema year to the internal registry. Note
+// that it consumes the passed-in io.Reader so callers should be aware.
+func (v Validator) Add(name string, year int, r io.Reader) error {
 	var err error
 	s := &schema{}
 	s.contents, err = ioutil.ReadAll(r)
@@ -169,35 +218,223 @@ func (v Validator) Add(name string, r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	v[name] = s
+	v[schemaKey{name, year}] = s
+	return nil
+}
+
+func (v Validator) addFile(name string, year int, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("opening %s schema from file %s: %v", name, filename, err)
+	}
+	defer f.Close()
+	if err := v.Add(name, year, f); err != nil {
+		return fmt.Errorf("adding %s schema from file %s: %v", name, filename, err)
+	}
 	return nil
 }
 
+// lookup returns the schema registered for name and schema year, falling
+// back to the default for name.
+func (v Validator) lookup(name string, year int) (*schema, bool) {
+	if s, ok := v[schemaKey{name, year}]; ok {
+		return s, true
+	}
+	s, ok := v[schemaKey{name, 0}]
+	return s, ok
+}
+
 var ErrSchemaUnknown = errors.New("validator: unknown schema")
 
-const maxValidationErrs = 500
+// defaultMaxErrors is how many errors a response lists when the request
+// doesn't ask for a particular number.
+const defaultMaxErrors = 500
+
+// parseMaxErrors interprets a maxErrors request parameter, falling back to
+// defaultMaxErrors and clamping to the server's ceiling.
+func parseMaxErrors(s string) int {
+	n := defaultMaxErrors
+	if s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			logger.Errorf("invalid maxErrors %q", s)
+			n = defaultMaxErrors
+		}
+	}
+	if n > *maxErrorsCeiling {
+		n = *maxErrorsCeiling
+	}
+	return n
+}
 
+// Validate checks jsonDoc against the named schema for the given schema
+// year, collecting up to the server's ceiling of errors.
 func (v Validator) Validate(schemaName string, schemaYearFlag int, jsonDoc io.Reader) core.ValidationResult {
+	return v.validateUpTo(schemaName, schemaYearFlag, *maxErrorsCeiling, currentNPIs(), jsonDoc, nil)
+}
+
+// validateFor validates jsonDoc for the request resp describes, and says in
+// resp how provider NPIs were verified. report may be nil.
+func (v Validator) validateFor(resp *api.ValidationResponse, jsonDoc io.Reader, report reporter) core.ValidationResult {
+	// the NPI data may be reloaded meanwhile, so the response describes
+	// the data that was used
+	data := currentNPIs()
+	if resp.Schema == "providers" {
+		resp.NPIVerification = api.NPIVerified
+		if data == nil {
+			resp.NPIVerification = api.NPIChecksumOnly
+		}
+	}
+	return v.validateUpTo(resp.Schema, resp.SchemaYear, collectLimit(resp), data, jsonDoc, report)
+}
+
+// reporter is told about errors and warnings as our own checks find them,
+// before validation is done. It may be called from several goroutines at
+// once.
+type reporter func(core.ValidationResult)
+
+// validateUpTo is Validate that stops collecting errors at maxErrs and
+// checks provider NPIs against data, which may be nil. If report isn't nil
+// it is told about the NPI and schema checks' findings as they are found.
+func (v Validator) validateUpTo(schemaName string, schemaYearFlag, maxErrs int, data *npiData, jsonDoc io.Reader, report reporter) core.ValidationResult {
+	s, ok := v.lookup(schemaName, schemaYearFlag)
+	if !ok {
+		return coverage.NewValidationErrorResult(ErrSchemaUnknown)
+	}
+
+	// the built-in document types are checked by the richer coverage
+	// validators as well as the year's registered schema
+	var overlay func(io.Reader) core.ValidationResult
 	switch schemaName {
 	case "providers":
-		validator := coverage.NewStreamingProviderValidator(jsonDoc, schemaYearFlag, maxValidationErrs)
-		return validator.Valid(context.Background(), npiLookup)
+		// without NPI data the validator finds every NPI, leaving checkNPIs
+		// to check their check digits
+		var lookup coverage.NPILookup = anyNPI{}
+		if data != nil {
+			lookup = data.lookup
+		}
+		overlay = func(r io.Reader) core.ValidationResult {
+			return teeValidate(r, func(r io.Reader) core.ValidationResult {
+				validator := coverage.NewStreamingProviderValidator(r, schemaYearFlag, maxErrs)
+				return withoutNPIWarnings(validator.Valid(context.Background(), lookup))
+			}, func(r io.Reader) core.ValidationResult {
+				return checkNPIs(r, data, maxErrs, report)
+			})
+		}
 	case "drugs":
-		validator := coverage.NewStreamingDrugValidator(jsonDoc, schemaYearFlag, maxValidationErrs)
-		return validator.Valid(context.Background())
+		overlay = func(r io.Reader) core.ValidationResult {
+			validator := coverage.NewStreamingDrugValidator(r, schemaYearFlag, maxErrs)
+			return validator.Valid(context.Background())
+		}
 	case "index":
-		validator := coverage.NewIndexDocValidator(jsonDoc)
-		return validator.Validate(context.Background())
+		overlay = func(r io.Reader) core.ValidationResult {
+			validator := coverage.NewIndexDocValidator(r)
+			return validator.Validate(context.Background())
+		}
 	case "plans":
-		validator := coverage.NewStreamingPlanValidator(jsonDoc, schemaYearFlag, maxValidationErrs)
-		return validator.Valid()
-	default:
-		return coverage.NewValidationErrorResult(ErrSchemaUnknown)
+		overlay = func(r io.Reader) core.ValidationResult {
+			validator := coverage.NewStreamingPlanValidator(r, schemaYearFlag, maxErrs)
+			return validator.Valid()
+		}
+	}
+	// the schema is checked first since it reads the whole document, so
+	// the overlay sees all of it even if it stops early itself
+	return withoutDuplicateErrors(teeValidate(jsonDoc, func(r io.Reader) core.ValidationResult {
+		result := s.validate(r, maxErrs)
+		if overlay != nil && len(result.Errs) == 1 {
+			// the overlay still checks a document too large for the schema
+			if err, ok := result.Errs[0].(*docTooLargeError); ok {
+				result = core.ValidationResult{Warnings: []core.Warning{fixedWarning(err.Error())}}
+			}
+		}
+		if report != nil {
+			report(result)
+		}
+		return result
+	}, overlay))
+}
+
+// withoutDuplicateErrors drops errors reported by both the schema and an
+// overlay, keeping the first.
+func withoutDuplicateErrors(result core.ValidationResult) core.ValidationResult {
+	seen := make(map[string]bool)
+	errs := result.Errs[:0]
+	for _, err := range result.Errs {
+		if !seen[err.Error()] {
+			seen[err.Error()] = true
+			errs = append(errs, err)
+		}
+	}
+	result.Errs = errs
+	return result
+}
+
+// docTooLargeError is a document larger than maxSchemaSize.
+type docTooLargeError struct {
+	limit int64
+}
+
+func (e *docTooLargeError) Error() string {
+	return fmt.Sprintf("document is larger than %d bytes, so it wasn't checked against the schema", e.limit)
+}
+
+// fixedWarning is a core.Warning with a fixed message.
+type fixedWarning string
+
+func (w fixedWarning) Warning() string {
+	return string(w)
+}
+
+// validate checks jsonDoc against the parsed schema. Unlike the coverage
+// validators, it reads the whole document into memory, so documents larger
+// than maxSchemaSize are a *docTooLargeError instead. The rest of such a
+// document is still read, for anything validating alongside.
+func (s *schema) validate(jsonDoc io.Reader, maxErrs int) core.ValidationResult {
+	doc, err := ioutil.ReadAll(io.LimitReader(jsonDoc, *maxSchemaSize+1))
+	if err != nil {
+		return coverage.NewValidationErrorResult(err)
+	}
+	if int64(len(doc)) > *maxSchemaSize {
+		io.Copy(ioutil.Discard, jsonDoc)
+		return core.ValidationResult{Errs: []error{&docTooLargeError{*maxSchemaSize}}}
+	}
+	result, err := s.parsed.Validate(js.NewStringLoader(string(doc)))
+	if err != nil {
+		return coverage.NewValidationErrorResult(err)
+	}
+
+	var vr core.ValidationResult
+	for _, e := range result.Errors() {
+		if len(vr.Errs) >= maxErrs {
+			break
+		}
+		vr.Errs = append(vr.Errs, errors.New(e.String()))
 	}
+	return vr
+}
+
+// validateLocated validates jsonDoc for the request resp describes, and
+// also records where each top-level record of jsonDoc starts, for
+// locateFindings. If count is non-nil it is atomically incremented as
+// records are seen. report may be nil.
+func (v Validator) validateLocated(resp *api.ValidationResponse, jsonDoc io.Reader, count *int64, report reporter) (core.ValidationResult, []int64) {
+	return locatedValidate(jsonDoc, func(r io.Reader) core.ValidationResult {
+		return v.validateFor(resp, r, report)
+	}, nil, count)
 }
 
-func (v Validator) ServeFile(schemaName string, w http.ResponseWriter) {
-	schema, ok := v[schemaName]
+// collectLimit is how many errors to collect for resp: all it lists if it
+// is to fail fast, or else the server's ceiling, so that the ones it leaves
+// out can be counted.
+func collectLimit(resp *api.ValidationResponse) int {
+	if resp.FailFast && resp.MaxErrors > 0 {
+		return resp.MaxErrors
+	}
+	return *maxErrorsCeiling
+}
+
+func (v Validator) ServeFile(schemaName string, year int, w http.ResponseWriter) {
+	schema, ok := v.lookup(schemaName, year)
 	if !ok {
 		http.Error(w, http.StatusText(404), 404)
 		return
@@ -214,86 +451,321 @@ func (v Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(405), 405)
 		return
 	}
-	var resp ValidationResponse
-	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
-		resp = multipartFormValidate(v, w, r)
-	} else {
-		jsonDoc := r.FormValue("json")
-		year, err := strconv.Atoi(r.FormValue("schemaYear"))
-		if err != nil {
-			logger.Errorf("error converting schemaYear %q to int", r.FormValue("schemaYear"))
+	// ParseForm only reads url-encoded bodies; a multipart body may give
+	// its format and download as parts
+	r.ParseForm()
+	u := &uploads{w: w, v: v, download: r.Form.Get("download") != ""}
+	u.setFormat(r.Form.Get("format"), r.Header.Get("Accept"))
+	defer func() {
+		if u.stream != nil {
+			u.stream.close()
 		}
-		resp.SchemaYear = coverage.Year2SchemaYear(year)
-		result := v.Validate(r.FormValue("schema"), resp.SchemaYear, bytes.NewBufferString(jsonDoc))
-		renderWarningsErrors(w, &resp, &result)
+	}()
+
+	var err error
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		err = multipartFormValidate(v, w, r, u)
+	case strings.HasPrefix(contentType, "application/json"), strings.HasPrefix(contentType, "application/x-ndjson"), strings.HasPrefix(contentType, "application/zip"):
+		err = rawBodyValidate(v, r, u)
+	default:
+		var resp api.ValidationResponse
 		resp.Schema = r.FormValue("schema")
+		resp.SchemaYear, err = v.parseYear(resp.Schema, r.FormValue("schemaYear"))
+		if err != nil {
+			break
+		}
+		resp.MaxErrors = parseMaxErrors(r.FormValue("maxErrors"))
+		resp.FailFast = r.FormValue("failFast") != ""
+		err = u.add(resp, strings.NewReader(r.FormValue("json")), "", "")
+	}
+	if err == nil && len(u.resps) == 0 {
+		err = errors.New("json is required")
+	}
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if u.stream != nil {
+		u.stream.finish(u.resps[0].ValidationResponse)
+		return
 	}
 
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if serveReport(w, u.format, u.download, u.resps) {
+		return
+	}
+	var body interface{} = u.resps[0].ValidationResponse
+	if u.archive {
+		body = u.archiveResponse()
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
 		http.Error(w, http.StatusText(500), 500)
 	}
 }
 
-func multipartFormValidate(v Validator, w http.ResponseWriter, r *http.Request) ValidationResponse {
-	var resp ValidationResponse
-	var result core.ValidationResult
+// docValidator validates doc for the request resp describes and renders the
+// results into resp. It returns a reader the document can be re-read from,
+// or nil, and any *uploadError the request fails with.
+type docValidator func(resp *api.ValidationResponse, doc io.Reader) (io.ReadSeeker, error)
+
+// validateDoc is the docValidator for ordinary responses. A doc that can't
+// be re-read, such as a multipart upload, is spooled to disk first, so that
+// findings can be located and reports can quote their records. The spooled
+// copy is a *spooledFile for the caller to close.
+func (v Validator) validateDoc(resp *api.ValidationResponse, doc io.Reader) (io.ReadSeeker, error) {
+	src, ok := doc.(io.ReadSeeker)
+	if !ok {
+		f, _, err := spoolTemp(doc)
+		if _, ok := err.(*uploadError); ok {
+			return nil, err
+		}
+		if err != nil {
+			result := coverage.NewValidationErrorResult(err)
+			renderWarningsErrors(resp, &result)
+			return nil, nil
+		}
+		src, doc = f, f
+	}
+	result, records := v.validateLocated(resp, doc, nil, nil)
+	renderWarningsErrors(resp, &result)
+	locateFindings(resp.Findings, records, src)
+	return src, nil
+}
+
+// uploads validates the documents uploaded in a request, which may be
+// compressed or zip archives of several documents, with a response for each.
+type uploads struct {
+	w        http.ResponseWriter
+	v        Validator
+	validate docValidator
+	// format is the report format, for the record details it needs.
+	format   string
+	download bool
+	// stream is set for streamed formats, when only a single document can
+	// be validated.
+	stream *eventStream
+	// ndjson is set if documents have a record per line rather than being
+	// JSON arrays.
+	ndjson bool
+	// archive is set once a zip archive has been read.
+	archive bool
+	resps   []namedResponse
+}
+
+// setFormat sets the response format from a "format" parameter or, failing
+// that, an Accept header. It must be set before any document is added.
+func (u *uploads) setFormat(format, accept string) error {
+	if len(u.resps) > 0 {
+		return errors.New("format must come before json")
+	}
+	u.format = responseFormat(format, accept)
+	u.stream, u.validate = nil, u.v.validateDoc
+	if format := streamFormat(format, accept); format != "" {
+		u.stream = newEventStream(u.w, format, u.v)
+		u.validate = u.stream.validate
+	}
+	return nil
+}
+
+// add validates doc, an upload named name, if it has a file name, and sent
+// with the given Content-Encoding. resp describes the request.
+func (u *uploads) add(resp api.ValidationResponse, doc io.Reader, name, encoding string) error {
+	if u.stream != nil && len(u.resps) > 0 {
+		return errors.New("only one document can be streamed")
+	}
+	doc, isZip, err := openUpload(doc, name, encoding)
+	if err != nil {
+		return err
+	}
+	if !isZip {
+		if name == "" {
+			name = "document.json"
+		}
+		return u.addDocument(resp, name, doc)
+	}
+	if u.stream != nil {
+		return &uploadError{errors.New("zip archives can't be streamed")}
+	}
+	u.archive = true
+	return readZip(doc, name, func(name string, doc io.Reader) error {
+		return u.addDocument(resp, name, doc)
+	})
+}
+
+func (u *uploads) addDocument(resp api.ValidationResponse, name string, doc io.Reader) error {
+	var nd *ndjsonArray
+	if u.ndjson {
+		nd = newNDJSONArray(doc)
+		defer nd.Close()
+		doc = nd
+	}
+	named := namedResponse{Name: name, ValidationResponse: resp}
+	src, err := u.validate(&named.ValidationResponse, doc)
+	if err != nil {
+		return err
+	}
+	if f, ok := src.(*spooledFile); ok {
+		defer f.Close()
+	}
+	if src != nil {
+		named.fillRecordDetails(u.format, src)
+	}
+	// reports read records from the array, so positions are only mapped
+	// back once they're done with it
+	if nd != nil {
+		nd.originalPositions(named.Findings)
+	}
+	u.resps = append(u.resps, named)
+	return nil
+}
+
+// archiveResponse lists the responses for the documents of a zip archive.
+func (u *uploads) archiveResponse() api.ArchiveResponse {
+	resp := api.ArchiveResponse{Valid: true, Files: []api.FileResponse{}}
+	for _, named := range u.resps {
+		resp.Valid = resp.Valid && named.Valid
+		resp.Files = append(resp.Files, api.FileResponse{Name: named.Name, ValidationResponse: named.ValidationResponse})
+	}
+	return resp
+}
+
+// rawBodyValidate validates a request body that is the document itself,
+// with the schema, year and maxErrors in the query string:
+//
+//	POST /validate?schema=providers&year=2018
+//
+// The body is streamed into the validators. An NDJSON body is validated as
+// an array of its lines, and a zip archive as the documents in it.
+func rawBodyValidate(v Validator, r *http.Request, u *uploads) error {
+	query := r.URL.Query()
+	resp := api.ValidationResponse{
+		Schema:    query.Get("schema"),
+		MaxErrors: parseMaxErrors(query.Get("maxErrors")),
+		FailFast:  query.Get("failFast") != "",
+	}
+	var err error
+	resp.SchemaYear, err = v.parseYear(resp.Schema, query.Get("year"))
+	if err != nil {
+		return err
+	}
+
+	u.ndjson = strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson")
+	return u.add(resp, r.Body, "", r.Header.Get("Content-Encoding"))
+}
+
+func multipartFormValidate(v Validator, w http.ResponseWriter, r *http.Request, u *uploads) error {
+	resp := api.ValidationResponse{MaxErrors: parseMaxErrors("")}
+	var year string
 	reader, err := r.MultipartReader()
 	if err != nil {
-		logger.Errorf("There was an error: %s\n", err)
+		return &uploadError{err}
 	}
 
 	for {
 		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				logger.Errorf("There was an error: %s\n", err)
-			}
+			return &uploadError{err}
 		}
 		if part.FormName() == "schemaYear" {
 			buff, err := ioutil.ReadAll(part)
 			if err != nil {
-				logger.Errorf("Error reading schema year - %+v\n", err)
-			}
-			year, err := strconv.Atoi(string(buff))
-			if err != nil {
-				logger.Errorf("Error converting schema year to int")
+				return &uploadError{fmt.Errorf("reading schemaYear: %v", err)}
 			}
-			resp.SchemaYear = coverage.Year2SchemaYear(year)
+			year = string(buff)
 		}
 		if part.FormName() == "schema" {
 			buff, err := ioutil.ReadAll(part)
 			if err != nil {
-				logger.Errorf("Error reading schema name - %+v\n", err)
+				return &uploadError{fmt.Errorf("reading schema: %v", err)}
 			}
 			resp.Schema = string(buff)
 		}
+		if part.FormName() == "maxErrors" {
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return &uploadError{fmt.Errorf("reading maxErrors: %v", err)}
+			}
+			resp.MaxErrors = parseMaxErrors(string(buff))
+		}
+		if part.FormName() == "failFast" {
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return &uploadError{fmt.Errorf("reading failFast: %v", err)}
+			}
+			resp.FailFast = len(buff) != 0
+		}
+		if part.FormName() == "format" {
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return &uploadError{fmt.Errorf("reading format: %v", err)}
+			}
+			if err := u.setFormat(string(buff), r.Header.Get("Accept")); err != nil {
+				return err
+			}
+		}
+		if part.FormName() == "download" {
+			buff, err := ioutil.ReadAll(part)
+			if err != nil {
+				return &uploadError{fmt.Errorf("reading download: %v", err)}
+			}
+			u.download = len(buff) != 0
+		}
 		if part.FormName() == "json" {
-			result = v.Validate(resp.Schema, resp.SchemaYear, part)
-			renderWarningsErrors(w, &resp, &result)
+			// the year can only be checked once the schema is known
+			if resp.SchemaYear, err = v.parseYear(resp.Schema, year); err != nil {
+				return err
+			}
+			if err := u.add(resp, part, part.FileName(), part.Header.Get("Content-Encoding")); err != nil {
+				return err
+			}
 		}
 	}
-	return resp
+	return nil
 }
 
-func renderWarningsErrors(w http.ResponseWriter, resp *ValidationResponse, result *core.ValidationResult) {
+func renderWarningsErrors(resp *api.ValidationResponse, result *core.ValidationResult) {
+	resp.Findings = []api.Finding{}
 	if len(result.Errs) != 0 {
 		resp.Valid = false
 		if result.Errs[0] == ErrSchemaUnknown {
 			resp.Errors = []string{fmt.Sprintf("This schema is unknown: %q", resp.Schema)}
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				http.Error(w, http.StatusText(500), 500)
-			}
-
+			resp.Warnings = []string{}
+			resp.Findings = append(resp.Findings, newFinding(api.SeverityError, resp.Errors[0]))
+			resp.Summary = summarize(resp.Findings)
+			return
 		}
 	} else {
 		resp.Errors = []string{}
 		resp.Valid = true
 	}
-	for _, err := range result.Errs {
+
+	// summarize every error, including those that are left out below
+	errFindings := make([]api.Finding, len(result.Errs))
+	for i, err := range result.Errs {
+		errFindings[i] = newFinding(api.SeverityError, err.Error())
+	}
+	warnFindings := make([]api.Finding, len(result.Warnings))
+	for i, warning := range result.Warnings {
+		warnFindings[i] = newFinding(api.SeverityWarning, warning.Warning())
+	}
+	resp.Summary = summarize(append(append([]api.Finding{}, errFindings...), warnFindings...))
+
+	errs := result.Errs
+	if resp.MaxErrors > 0 && len(errs) > resp.MaxErrors {
+		resp.SuppressedErrors = len(errs) - resp.MaxErrors
+		errs = errs[:resp.MaxErrors]
+		errFindings = errFindings[:resp.MaxErrors]
+	}
+	// the validators stop collecting at their limit, so there may be more
+	resp.Truncated = resp.SuppressedErrors > 0 || len(result.Errs) >= collectLimit(resp)
+	for _, err := range errs {
 		resp.Errors = append(resp.Errors, err.Error())
 	}
+	resp.Findings = append(resp.Findings, errFindings...)
 
 	if len(result.Warnings) == 0 {
 		resp.Warnings = []string{}
@@ -301,12 +773,5 @@ func renderWarningsErrors(w http.ResponseWriter, resp *ValidationResponse, resul
 	for _, warning := range result.Warnings {
 		resp.Warnings = append(resp.Warnings, warning.Warning())
 	}
-}
-
-type ValidationResponse struct {
-	Valid      bool     `json:"valid"`
-	Errors     []string `json:"errors"`
-	Warnings   []string `json:"warnings"`
-	Schema     string   `json:"schema"`
-	SchemaYear int      `json:"year"`
+	resp.Findings = append(resp.Findings, warnFindings...)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// ndjsonArray turns newline-delimited JSON into a JSON array of its lines,
+// as the validators expect. Each line stays on its own line, but gains the
+// "[" or "," that starts it, so positions in the array are mapped back to
+// the original with original once it has been read.
+type ndjsonArray struct {
+	pr *io.PipeReader
+
+	mu sync.Mutex
+	// lines that a "[" or "," was added to, in order
+	lines []int
+}
+
+func newNDJSONArray(r io.Reader) *ndjsonArray {
+	pr, pw := io.Pipe()
+	a := &ndjsonArray{pr: pr}
+	go func() {
+		pw.CloseWithError(a.write(pw, r))
+	}()
+	return a
+}
+
+func (a *ndjsonArray) Read(p []byte) (int, error) {
+	return a.pr.Read(p)
+}
+
+// Close stops the conversion, so that it doesn't wait on a reader that
+// won't read the rest of the array.
+func (a *ndjsonArray) Close() error {
+	return a.pr.Close()
+}
+
+func (a *ndjsonArray) write(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	br := bufio.NewReader(r)
+	sep := byte('[')
+	for line := 1; ; line++ {
+		text, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(text)) > 0 {
+			bw.WriteByte(sep)
+			sep = ','
+			a.mu.Lock()
+			a.lines = append(a.lines, line)
+			a.mu.Unlock()
+		}
+		bw.Write(text)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if sep == '[' {
+		bw.WriteByte(sep)
+	}
+	bw.WriteByte(']')
+	return bw.Flush()
+}
+
+// original returns the position in the original document of pos, a
+// position in the array.
+func (a *ndjsonArray) original(pos api.Position) *api.Position {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	before := sort.SearchInts(a.lines, pos.Line)
+	pos.Offset -= int64(before)
+	if before < len(a.lines) && a.lines[before] == pos.Line && pos.Column > 1 {
+		pos.Offset--
+		pos.Column--
+	}
+	return &pos
+}
+
+// originalPositions maps the positions of findings back to the original
+// document.
+func (a *ndjsonArray) originalPositions(findings []api.Finding) {
+	for i := range findings {
+		f := &findings[i]
+		if f.RecordPosition != nil {
+			f.RecordPosition = a.original(*f.RecordPosition)
+		}
+		if f.Position != nil {
+			f.Position = a.original(*f.Position)
+		}
+	}
+}
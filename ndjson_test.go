@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+func TestNDJSONArrayOriginal(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		doc  string
+	}{
+		{"one per line", "{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n"},
+		{"no final newline", "{\"a\":1}\n{\"b\":2}"},
+		{"blank lines", "\n{\"a\":1}\n\n\n{\"b\":2}\n\n"},
+		{"indented", "  {\"a\":1}\n\t{\"b\":2}\n   \n {\"c\":3}\n"},
+		{"crlf", "{\"a\":1}\r\n\r\n{\"b\":2}\r\n"},
+		{"multi-byte", "{\"é\":\"ü\"}\n  {\"b\":\"ß\"}\n"},
+	} {
+		nd := newNDJSONArray(strings.NewReader(test.doc))
+		array, err := ioutil.ReadAll(nd)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		offsets := scanRecordOffsets(strings.NewReader(string(array)), nil)
+		positions := positionsAt(strings.NewReader(string(array)), offsets)
+		want := ndjsonRecordPositions(test.doc)
+		if len(offsets) != len(want) {
+			t.Fatalf("%s: found %d records, want %d", test.name, len(offsets), len(want))
+		}
+		for i, offset := range offsets {
+			if got := *nd.original(positions[offset]); got != want[i] {
+				t.Errorf("%s: record %d is at %+v, want %+v", test.name, i, got, want[i])
+			}
+		}
+	}
+}
+
+// ndjsonRecordPositions returns where each record of an NDJSON document
+// starts: the first non-blank byte of each non-blank line.
+func ndjsonRecordPositions(doc string) []api.Position {
+	var positions []api.Position
+	var offset int64
+	line := 1
+	for _, text := range strings.SplitAfter(doc, "\n") {
+		if trimmed := strings.TrimLeft(text, " \t\r\n"); trimmed != "" {
+			indent := text[:len(text)-len(trimmed)]
+			positions = append(positions, api.Position{
+				Offset: offset + int64(len(indent)),
+				Line:   line,
+				Column: 1 + len([]rune(indent)),
+			})
+		}
+		offset += int64(len(text))
+		line++
+	}
+	return positions
+}
+
+func TestNDJSONArrayClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	doc := strings.Repeat("{\"a\":1}\n", 1<<16)
+	for i := 0; i < 5; i++ {
+		nd := newNDJSONArray(strings.NewReader(doc))
+		// read a little of the array, as a validator that gives up would
+		bufio.NewReader(nd).ReadByte()
+		nd.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left converting NDJSON", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
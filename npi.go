@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// NPIStatus describes the NPI data currently in use.
+type NPIStatus struct {
+	File        string    `json:"file"`
+	Count       int       `json:"count"`
+	LoadedAt    time.Time `json:"loaded_at"`
+	LoadSeconds float64   `json:"load_seconds"`
+}
+
+type npiData struct {
+	lookup *NPIIndex
+	// details is only populated if -npi-details is set and the NPI file
+	// has the NPPES columns for them.
+	details map[int]npiDetail
+	status  NPIStatus
+}
+
+// npiDetail holds what we keep about an NPI beyond its entity type.
+type npiDetail struct {
+	Name        string
+	Deactivated time.Time
+	Reactivated time.Time
+}
+
+// deactivated reports whether the NPI is deactivated and hasn't been
+// reactivated since.
+func (d npiDetail) deactivated() bool {
+	return !d.Deactivated.IsZero() && d.Reactivated.Before(d.Deactivated)
+}
+
+// Column names in the NPPES dissemination file. The two-column file made by
+// tools/npi-csv keeps the first two.
+const (
+	nppesNPI          = "NPI"
+	nppesEntityType   = "Entity Type Code"
+	nppesDeactivation = "NPI Deactivation Date"
+	nppesReactivation = "NPI Reactivation Date"
+	nppesOrgName      = "Provider Organization Name (Legal Business Name)"
+	nppesFirstName    = "Provider First Name"
+	nppesLastName     = "Provider Last Name (Legal Name)"
+
+	nppesDateFormat = "01/02/2006"
+)
+
+var (
+	// npis holds the current *npiData. It is swapped wholesale on reload,
+	// so a validation keeps using the lookup that was current when it
+	// started.
+	npis atomic.Value
+	// npiReloadMu keeps concurrent reloads from doubling memory use.
+	npiReloadMu sync.Mutex
+)
+
+// currentNPIs returns the NPI data in use, or nil if none is loaded.
+func currentNPIs() *npiData {
+	data, _ := npis.Load().(*npiData)
+	return data
+}
+
+// loadNPIs reads the NPI file into a fresh lookup and swaps it in.
+func loadNPIs() (NPIStatus, error) {
+	npiReloadMu.Lock()
+	defer npiReloadMu.Unlock()
+
+	t0 := time.Now()
+	data, err := readNPIs(*npiFile, *hasHeader, *npiDetails)
+	if err != nil {
+		return NPIStatus{}, err
+	}
+	data.status = NPIStatus{
+		File:        *npiFile,
+		Count:       data.lookup.Len(),
+		LoadedAt:    time.Now(),
+		LoadSeconds: time.Now().Sub(t0).Seconds(),
+	}
+	npis.Store(data)
+
+	logger.Infof("loaded %d NPIs in %v", data.status.Count, time.Now().Sub(t0))
+	return data.status, nil
+}
+
+// readNPIs reads an NPI index made by the npi-index subcommand, or an NPI
+// CSV file, either the NPPES dissemination file or the two-column extract
+// made by tools/npi-csv. Either may be gzip or bzip2 compressed. With a
+// header row, CSV columns are found by name; without one the NPI and entity
+// type must be the first two columns. If keepDetails is set, provider names
+// and deactivation and reactivation dates are kept as well, which an index
+// doesn't have.
+func readNPIs(filename string, header, keepDetails bool) (*npiData, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening NPI file: %s", filename)
+	}
+	defer file.Close()
+
+	r, err := decompress(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading NPI file: %v", err)
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(npiIndexMagic)); bytes.Equal(magic, npiIndexMagic) {
+		lookup, err := ReadNPIIndex(br)
+		if err != nil {
+			return nil, fmt.Errorf("error reading NPI index: %v", err)
+		}
+		return &npiData{lookup: lookup}, nil
+	}
+
+	data := &npiData{lookup: &NPIIndex{}}
+	if keepDetails {
+		data.details = make(map[int]npiDetail)
+	}
+	reader := csv.NewReader(br)
+	cols := map[string]int{nppesNPI: 0, nppesEntityType: 1}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading NPI file: %v", err)
+		}
+
+		if header {
+			header = false
+			cols = make(map[string]int)
+			for i, name := range record {
+				cols[name] = i
+			}
+			for _, name := range []string{nppesNPI, nppesEntityType} {
+				if _, ok := cols[name]; !ok {
+					return nil, fmt.Errorf("NPI file has no %q column", name)
+				}
+			}
+			continue
+		}
+
+		npi, err := strconv.Atoi(record[cols[nppesNPI]])
+
+		if err != nil {
+			logger.Infof("error converting NPI string to int: %q", record[cols[nppesNPI]])
+			return nil, err
+		}
+
+		// some npis in the file do not have types associated with them
+		if e := record[cols[nppesEntityType]]; e != "" {
+			entity, err := strconv.Atoi(e)
+			if err != nil {
+				logger.Infof("error converting entity string to int: %q", e)
+				return nil, err
+			}
+			if err := data.lookup.add(npi, entity); err != nil {
+				logger.Infof("error adding NPI %d: %v", npi, err)
+				return nil, err
+			}
+		}
+
+		if data.details != nil {
+			var d npiDetail
+			d.Name = nppesName(record, cols)
+			d.Deactivated = nppesDate(record, cols, nppesDeactivation)
+			d.Reactivated = nppesDate(record, cols, nppesReactivation)
+			if d != (npiDetail{}) {
+				data.details[npi] = d
+			}
+		}
+	}
+
+	data.lookup.sort()
+	return data, nil
+}
+
+// nppesName returns the organization or individual name in record, if the
+// file has the name columns.
+func nppesName(record []string, cols map[string]int) string {
+	field := func(name string) string {
+		if i, ok := cols[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+	if org := field(nppesOrgName); org != "" {
+		return org
+	}
+	return strings.TrimSpace(field(nppesFirstName) + " " + field(nppesLastName))
+}
+
+// nppesDate parses the named date column of record, returning the zero time
+// if the column is missing, empty or malformed.
+func nppesDate(record []string, cols map[string]int, name string) time.Time {
+	i, ok := cols[name]
+	if !ok || record[i] == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(nppesDateFormat, record[i])
+	if err != nil {
+		logger.Infof("error parsing %s %q", name, record[i])
+	}
+	return t
+}
+
+// reloadNPIsOnSIGHUP reloads the NPI file whenever the process receives
+// SIGHUP.
+func reloadNPIsOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			logger.Infof("SIGHUP received, reloading NPIs from %s", *npiFile)
+			if _, err := loadNPIs(); err != nil {
+				logger.Errorf("error reloading npis, keeping the old ones: %v", err)
+			}
+		}
+	}()
+}
+
+// serveNPIReload handles POSTs to /admin/npis/reload.
+func serveNPIReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	status, err := loadNPIs()
+	if err != nil {
+		logger.Errorf("error reloading npis, keeping the old ones: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// Health is the response to /health.
+type Health struct {
+	// Status is "ok", or "degraded" if there is no NPI data.
+	Status string     `json:"status"`
+	NPIs   *NPIStatus `json:"npis"`
+}
+
+// serveHealth reports whether the validator is running with NPI data.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: "degraded"}
+	if data := currentNPIs(); data != nil {
+		health.Status = "ok"
+		health.NPIs = &data.status
+	}
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// requireAdmin only passes on requests bearing the admin token.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Bearer " + *adminToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			http.Error(w, http.StatusText(401), 401)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
+	"github.com/adhocteam/qhpvalidator/api"
+	js "github.com/xeipuuv/gojsonschema"
+)
+
+// NPI errors and warnings. They are formatted like gojsonschema errors so
+// they can be parsed into Findings, each with its own rule.
+const (
+	npiInvalidChecksum    = "invalid NPI checksum"
+	npiNotFound           = "NPI not found"
+	npiDeactivated        = "NPI deactivated on %s"
+	npiEntityTypeMismatch = "NPI is an %s but listed as %s"
+)
+
+// NPPES entity type codes.
+const (
+	entityIndividual   = 1
+	entityOrganization = 2
+)
+
+// checkNPIs reports providers whose NPI has a bad check digit, and warns
+// about those whose NPI isn't in data, is deactivated, or belongs to a
+// different kind of entity than the provider's type. Names and deactivations
+// are only known if the NPI file had them. Malformed records are left to the
+// schema validator to report. If report isn't nil it is told about each
+// finding as it is found.
+func checkNPIs(r io.Reader, data *npiData, maxErrs int, report reporter) core.ValidationResult {
+	var result core.ValidationResult
+	dec := json.NewDecoder(r)
+	err := decodeArray(dec, func(i int) error {
+		var provider struct {
+			NPI  string `json:"npi"`
+			Type string `json:"type"`
+		}
+		if err := dec.Decode(&provider); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				return nil
+			}
+			return err
+		}
+		if !npiPattern.MatchString(provider.NPI) {
+			return nil
+		}
+
+		context := js.STRING_CONTEXT_ROOT + "." + strconv.Itoa(i) + ".npi"
+		value := strconv.Quote(provider.NPI)
+		npi, _ := strconv.Atoi(provider.NPI)
+		var found core.ValidationResult
+		if !validNPIChecksum(provider.NPI) {
+			found.Errs = []error{errors.New(fmt.Sprintf(js.RESULT_ERROR_FORMAT, context, npiInvalidChecksum, value))}
+		} else if msg := npiMessage(data, npi, provider.Type); msg != "" {
+			found.Warnings = []core.Warning{fixedWarning(fmt.Sprintf(js.RESULT_ERROR_FORMAT, context, msg, value))}
+		}
+		if report != nil && (len(found.Errs) > 0 || len(found.Warnings) > 0) {
+			report(found)
+		}
+		result.Errs = append(result.Errs, found.Errs...)
+		result.Warnings = append(result.Warnings, found.Warnings...)
+		if maxErrs > 0 && (len(result.Errs) >= maxErrs || len(result.Warnings) >= maxErrs) {
+			return errMaxErrs
+		}
+		return nil
+	})
+	if err != nil && err != errMaxErrs {
+		logger.Infof("checking NPIs: %v", err)
+	}
+	return result
+}
+
+// npiPattern is the npi pattern from the providers schema.
+var npiPattern = regexp.MustCompile(`^[0-9]{10}$`)
+
+// validNPIChecksum reports whether the last digit of a 10-digit NPI is the
+// Luhn check digit of the other nine, prefixed with 80840 as the NPI
+// standard requires.
+func validNPIChecksum(npi string) bool {
+	digits := "80840" + npi
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// double every second digit from the right, skipping the check digit
+		if (len(digits)-1-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// npiMessage describes what is wrong with a provider's NPI, or returns ""
+// if nothing is or there is no NPI data to check against.
+func npiMessage(data *npiData, npi int, providerType string) string {
+	if data == nil {
+		return ""
+	}
+	detail, hasDetail := data.details[npi]
+	entity, ok := data.lookup.Lookup(npi)
+	switch {
+	case hasDetail && detail.deactivated():
+		return fmt.Sprintf(npiDeactivated, detail.Deactivated.Format(nppesDateFormat)) + nameSuffix(detail)
+	case !ok && !hasDetail:
+		return npiNotFound
+	case entity == entityOrganization && providerType == "INDIVIDUAL":
+		return fmt.Sprintf(npiEntityTypeMismatch, "organization", providerType) + nameSuffix(detail)
+	case entity == entityIndividual && (providerType == "FACILITY" || providerType == "GROUP"):
+		return fmt.Sprintf(npiEntityTypeMismatch, "individual", providerType) + nameSuffix(detail)
+	}
+	return ""
+}
+
+func nameSuffix(d npiDetail) string {
+	if d.Name == "" {
+		return ""
+	}
+	return " (" + d.Name + ")"
+}
+
+// anyNPI is the lookup the providers validator gets when there is no NPI
+// data. It finds every NPI, with no entity type, so that the validator
+// doesn't warn that they are all missing.
+type anyNPI struct{}
+
+func (anyNPI) Lookup(npi int) (int, bool) {
+	return 0, true
+}
+
+// withoutNPIWarnings drops the providers validator's own NPI warnings, which
+// checkNPIs replaces with more specific ones.
+func withoutNPIWarnings(result core.ValidationResult) core.ValidationResult {
+	warnings := result.Warnings[:0]
+	for _, w := range result.Warnings {
+		if !strings.HasSuffix(newFinding(api.SeverityWarning, w.Warning()).Path, ".npi") {
+			warnings = append(warnings, w)
+		}
+	}
+	result.Warnings = warnings
+	return result
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestValidNPIChecksum(t *testing.T) {
+	for _, test := range []struct {
+		npi   string
+		valid bool
+	}{
+		{"1234567893", true},
+		{"1245319599", true},
+		{"1003000126", true},
+		// wrong check digit
+		{"1234567890", false},
+		{"1245319598", false},
+		// a changed digit
+		{"2234567893", false},
+		// swapped digits
+		{"1234567839", false},
+		{"0000000000", false},
+	} {
+		if got := validNPIChecksum(test.npi); got != test.valid {
+			t.Errorf("validNPIChecksum(%q) = %v, want %v", test.npi, got, test.valid)
+		}
+	}
+}
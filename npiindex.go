@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+)
+
+// npiIndexMagic starts an NPI index file, followed by a little-endian
+// uint32 version and record count, the sorted NPIs as little-endian uint32s,
+// then one entity type byte per NPI.
+var npiIndexMagic = []byte("NPIX")
+
+const npiIndexVersion = 1
+
+// NPIIndex maps NPIs to entity types using sorted parallel arrays, about 5
+// bytes an NPI against the tens a map needs. NPIs are 10 digits starting
+// with 1 or 2, so they fit in a uint32.
+type NPIIndex struct {
+	npis  []uint32
+	types []uint8
+}
+
+// the providers validator takes an NPIIndex in place of the map it came with
+var _ coverage.NPILookup = (*NPIIndex)(nil)
+
+// Lookup returns the entity type of npi, and whether it is in the index.
+func (idx *NPIIndex) Lookup(npi int) (int, bool) {
+	if npi < 0 || npi > 1<<32-1 {
+		return 0, false
+	}
+	n := uint32(npi)
+	i := sort.Search(len(idx.npis), func(i int) bool { return idx.npis[i] >= n })
+	if i == len(idx.npis) || idx.npis[i] != n {
+		return 0, false
+	}
+	return int(idx.types[i]), true
+}
+
+// add appends an NPI; call sort before using the index.
+func (idx *NPIIndex) add(npi, entity int) error {
+	if npi < 0 || npi > 1<<32-1 || entity < 0 || entity > 255 {
+		return errors.New("NPI or entity type out of range")
+	}
+	idx.npis = append(idx.npis, uint32(npi))
+	idx.types = append(idx.types, uint8(entity))
+	return nil
+}
+
+func (idx *NPIIndex) sort() {
+	// the NPPES file is already in NPI order
+	if !sort.IsSorted(idx) {
+		sort.Sort(idx)
+	}
+}
+
+// Len returns the number of NPIs in the index.
+func (idx *NPIIndex) Len() int {
+	return len(idx.npis)
+}
+
+func (idx *NPIIndex) Less(i, j int) bool {
+	return idx.npis[i] < idx.npis[j]
+}
+
+func (idx *NPIIndex) Swap(i, j int) {
+	idx.npis[i], idx.npis[j] = idx.npis[j], idx.npis[i]
+	idx.types[i], idx.types[j] = idx.types[j], idx.types[i]
+}
+
+// WriteTo writes the index in the format ReadNPIIndex reads.
+func (idx *NPIIndex) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(npiIndexMagic)+8)
+	copy(header, npiIndexMagic)
+	binary.LittleEndian.PutUint32(header[len(npiIndexMagic):], npiIndexVersion)
+	binary.LittleEndian.PutUint32(header[len(npiIndexMagic)+4:], uint32(len(idx.npis)))
+	bw.Write(header)
+
+	var b [4]byte
+	for _, npi := range idx.npis {
+		binary.LittleEndian.PutUint32(b[:], npi)
+		bw.Write(b[:])
+	}
+	bw.Write(idx.types)
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return int64(len(header) + 5*len(idx.npis)), nil
+}
+
+var errNotNPIIndex = errors.New("not an NPI index file")
+
+// ReadNPIIndex reads an index written by WriteTo.
+func ReadNPIIndex(r io.Reader) (*NPIIndex, error) {
+	header := make([]byte, len(npiIndexMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(npiIndexMagic)], npiIndexMagic) {
+		return nil, errNotNPIIndex
+	}
+	if v := binary.LittleEndian.Uint32(header[len(npiIndexMagic):]); v != npiIndexVersion {
+		return nil, errors.New("unsupported NPI index version")
+	}
+	n := int(binary.LittleEndian.Uint32(header[len(npiIndexMagic)+4:]))
+
+	buf := make([]byte, 4*n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	idx := &NPIIndex{npis: make([]uint32, n), types: make([]uint8, n)}
+	for i := range idx.npis {
+		idx.npis[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	if _, err := io.ReadFull(r, idx.types); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
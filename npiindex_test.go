@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+)
+
+// benchNPIs is about a sixth of the NPPES file, enough to be well out of
+// cache without slowing the benchmarks down too much to set up.
+const benchNPIs = 1 << 20
+
+// randomNPIs returns n distinct NPIs with entity types, in random order.
+func randomNPIs(n int) map[int]int {
+	rnd := rand.New(rand.NewSource(1))
+	npis := make(map[int]int, n)
+	for len(npis) < n {
+		npis[1000000000+rnd.Intn(1000000000)] = 1 + rnd.Intn(2)
+	}
+	return npis
+}
+
+func buildIndex(t testing.TB, npis map[int]int) *NPIIndex {
+	idx := &NPIIndex{}
+	for npi, entity := range npis {
+		if err := idx.add(npi, entity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.sort()
+	return idx
+}
+
+func TestNPIIndexRoundTrip(t *testing.T) {
+	npis := randomNPIs(1000)
+	var buf bytes.Buffer
+	n, err := buildIndex(t, npis).WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+
+	idx, err := ReadNPIIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != len(npis) {
+		t.Fatalf("read %d NPIs, want %d", idx.Len(), len(npis))
+	}
+	for npi, want := range npis {
+		if entity, ok := idx.Lookup(npi); !ok || entity != want {
+			t.Errorf("Lookup(%d) = %d, %v, want %d, true", npi, entity, ok, want)
+		}
+	}
+	for _, npi := range []int{0, 999999999, 1 << 33, -1} {
+		if _, ok := idx.Lookup(npi); ok {
+			t.Errorf("Lookup(%d) found an NPI that isn't there", npi)
+		}
+	}
+}
+
+func TestReadNPIIndexRejectsOtherFiles(t *testing.T) {
+	if _, err := ReadNPIIndex(bytes.NewBufferString("NPI,Entity Type Code\n")); err != errNotNPIIndex {
+		t.Errorf("got %v, want errNotNPIIndex", err)
+	}
+}
+
+// lookupKeys returns the NPIs to look up, half of them in npis.
+func lookupKeys(npis map[int]int) []int {
+	rnd := rand.New(rand.NewSource(2))
+	var keys []int
+	for npi := range npis {
+		keys = append(keys, npi, 1000000000+rnd.Intn(1000000000))
+		if len(keys) >= 1<<16 {
+			break
+		}
+	}
+	return keys
+}
+
+func BenchmarkNPIIndexLookup(b *testing.B) {
+	npis := randomNPIs(benchNPIs)
+	idx := buildIndex(b, npis)
+	keys := lookupKeys(npis)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Lookup(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkMapLookup(b *testing.B) {
+	npis := randomNPIs(benchNPIs)
+	lookup := coverage.NewInMemoryNPILookup()
+	for npi, entity := range npis {
+		lookup.NPIProviderType[npi] = entity
+	}
+	keys := lookupKeys(npis)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup.Lookup(keys[i%len(keys)])
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
+	"github.com/adhocteam/qhpvalidator/api"
+	js "github.com/xeipuuv/gojsonschema"
+)
+
+// locatedValidate is teeValidate that also records the offset where each
+// top-level record of r starts. If count is non-nil it is atomically
+// incremented as records are seen.
+func locatedValidate(r io.Reader, validate, check func(io.Reader) core.ValidationResult, count *int64) (core.ValidationResult, []int64) {
+	var records []int64
+	result := teeValidate(r, func(r io.Reader) core.ValidationResult {
+		return teeValidate(r, validate, check)
+	}, func(r io.Reader) core.ValidationResult {
+		records = scanRecordOffsets(r, count)
+		return core.ValidationResult{}
+	})
+	return result, records
+}
+
+// scanRecordOffsets returns the offset of each element of the top-level
+// JSON array in r. Large documents have millions of records, so only
+// offsets are kept; locateFindings works out the lines and columns of the
+// few records with findings.
+func scanRecordOffsets(r io.Reader, count *int64) []int64 {
+	var records []int64
+	s := newJSONScanner(r, api.Position{Line: 1, Column: 1}, 0)
+	s.scan(func(pos api.Position) bool {
+		if len(s.stack) == 1 && s.stack[0].array {
+			records = append(records, pos.Offset)
+			if count != nil {
+				atomic.AddInt64(count, 1)
+			}
+		}
+		return false
+	})
+	return records
+}
+
+// locateFindings fills in the record and value positions of findings from
+// the record offsets in records. Lines, columns and value positions are
+// only found if src can be re-read; otherwise findings are located by the
+// record's offset alone.
+func locateFindings(findings []api.Finding, records []int64, src io.ReadSeeker) {
+	var offsets []int64
+	for _, f := range findings {
+		if f.Record >= 0 && f.Record < len(records) {
+			offsets = append(offsets, records[f.Record])
+		}
+	}
+	var positions map[int64]api.Position
+	if src != nil {
+		positions = positionsAt(src, offsets)
+	}
+
+	for i := range findings {
+		f := &findings[i]
+		if f.Record < 0 || f.Record >= len(records) {
+			continue
+		}
+		recordPos, ok := positions[records[f.Record]]
+		if !ok {
+			recordPos = api.Position{Offset: records[f.Record]}
+		}
+		f.RecordPosition = &recordPos
+
+		target := pathSegments(f.Path)[1:]
+		if len(target) == 0 {
+			f.Position = &recordPos
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if pos, ok := findValue(src, recordPos, target); ok {
+			f.Position = &pos
+		}
+	}
+}
+
+// positionsAt returns the position of each of offsets in src, reading src
+// once from the start up to the last of them.
+func positionsAt(src io.ReadSeeker, offsets []int64) map[int64]api.Position {
+	positions := make(map[int64]api.Position)
+	if len(offsets) == 0 {
+		return positions
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return positions
+	}
+	sort.Sort(int64s(offsets))
+	s := newJSONScanner(src, api.Position{Line: 1, Column: 1}, 0)
+	for _, offset := range offsets {
+		for s.pos.Offset < offset {
+			if _, err := s.readByte(); err != nil {
+				return positions
+			}
+		}
+		positions[offset] = s.pos
+	}
+	return positions
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// pathSegments splits a gojsonschema context like "(root).3.plans.0" into
+// ["3", "plans", "0"].
+func pathSegments(path string) []string {
+	path = strings.TrimPrefix(path, js.STRING_CONTEXT_ROOT)
+	if path == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(path, "."), ".")
+}
+
+// findValue scans the value starting at start for the one at path, relative
+// to it.
+func findValue(src io.ReadSeeker, start api.Position, path []string) (api.Position, bool) {
+	if _, err := src.Seek(start.Offset, io.SeekStart); err != nil {
+		return api.Position{}, false
+	}
+	var (
+		found api.Position
+		ok    bool
+	)
+	s := newJSONScanner(src, start, len(path))
+	s.scan(func(pos api.Position) bool {
+		if len(s.stack) != len(path) {
+			return false
+		}
+		for i, frame := range s.stack {
+			if frame.segment() != path[i] {
+				return false
+			}
+		}
+		found, ok = pos, true
+		return true
+	})
+	return found, ok
+}
+
+// jsonScanner walks a JSON value byte by byte, tracking the position and
+// path of each value it starts. It doesn't validate the JSON; the schema
+// validators do that.
+type jsonScanner struct {
+	r   *bufio.Reader
+	pos api.Position
+	// keys are only kept for objects up to this depth
+	maxDepth int
+	stack    []scanFrame
+}
+
+type scanFrame struct {
+	array   bool
+	index   int
+	key     string
+	wantKey bool
+}
+
+func (f scanFrame) segment() string {
+	if f.array {
+		return strconv.Itoa(f.index)
+	}
+	return f.key
+}
+
+func newJSONScanner(r io.Reader, start api.Position, maxDepth int) *jsonScanner {
+	return &jsonScanner{r: bufio.NewReader(r), pos: start, maxDepth: maxDepth}
+}
+
+func (s *jsonScanner) readByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.pos.Offset++
+	switch {
+	case c == '\n':
+		s.pos.Line++
+		s.pos.Column = 1
+	case c&0xC0 != 0x80: // not a UTF-8 continuation byte
+		s.pos.Column++
+	}
+	return c, nil
+}
+
+// scan calls fn with the position of each value as it starts, until fn
+// returns true or the outermost value ends. s.stack holds the path to the
+// value when fn is called.
+func (s *jsonScanner) scan(fn func(api.Position) bool) {
+	expect := true
+	for {
+		pos := s.pos
+		c, err := s.readByte()
+		if err != nil {
+			return
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		case '[', '{':
+			if expect && fn(pos) {
+				return
+			}
+			s.stack = append(s.stack, scanFrame{array: c == '[', wantKey: c == '{'})
+			expect = c == '['
+		case ']', '}':
+			if len(s.stack) == 0 {
+				return
+			}
+			s.stack = s.stack[:len(s.stack)-1]
+			if len(s.stack) == 0 {
+				return
+			}
+			expect = false
+		case ',':
+			if len(s.stack) == 0 {
+				return
+			}
+			top := &s.stack[len(s.stack)-1]
+			if top.array {
+				top.index++
+				expect = true
+			} else {
+				top.wantKey = true
+			}
+		case ':':
+			expect = true
+		case '"':
+			if n := len(s.stack); n > 0 && s.stack[n-1].wantKey {
+				top := &s.stack[n-1]
+				top.key, err = s.readString(n <= s.maxDepth)
+				top.wantKey = false
+				expect = false
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if expect && fn(pos) {
+				return
+			}
+			expect = false
+			if _, err := s.readString(false); err != nil {
+				return
+			}
+		default:
+			// numbers, true, false and null
+			if expect && fn(pos) {
+				return
+			}
+			expect = false
+		}
+	}
+}
+
+// readString consumes the rest of a string whose opening quote has been
+// read, returning its contents, unescaped as in gojsonschema's paths, if
+// keep is set.
+func (s *jsonScanner) readString(keep bool) (string, error) {
+	var buf []byte
+	escaped := false
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return "", err
+		}
+		if !escaped && c == '"' {
+			if bytes.IndexByte(buf, '\\') < 0 {
+				return string(buf), nil
+			}
+			var str string
+			// a malformed escape is the validators' business
+			if err := json.Unmarshal(append(append([]byte{'"'}, buf...), '"'), &str); err != nil {
+				return string(buf), nil
+			}
+			return str, nil
+		}
+		escaped = !escaped && c == '\\'
+		if keep {
+			buf = append(buf, c)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// positionOf returns the position of offset in doc.
+func positionOf(doc string, offset int) api.Position {
+	before := doc[:offset]
+	line := strings.Count(before, "\n") + 1
+	lineStart := strings.LastIndex(before, "\n") + 1
+	return api.Position{Offset: int64(offset), Line: line, Column: utf8.RuneCountInString(before[lineStart:]) + 1}
+}
+
+const positionsDoc = `[
+  {"a": {"b": [1, {"c": "x"}]}, "é": "ü", "k\"q": 5},
+	{"ß": "ä", "n": null, "nested": [[0, 1], [2, 3]]}
+]`
+
+func TestLocateFindings(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		// the text the value starts with, or "" if it can't be found
+		value  string
+		record int
+	}{
+		{"(root).0", `{"a"`, 0},
+		{"(root).1", `{"ß"`, 1},
+		{"(root).0.a", `{"b"`, 0},
+		{"(root).0.a.b.0", `1,`, 0},
+		{"(root).0.a.b.1.c", `"x"`, 0},
+		{"(root).0.é", `"ü"`, 0},
+		{`(root).0.k"q`, `5}`, 0},
+		{"(root).1.ß", `"ä"`, 1},
+		{"(root).1.n", `null`, 1},
+		{"(root).1.nested.1.0", `2,`, 1},
+		{"(root).0.missing", "", 0},
+		{"(root).1.nested.5", "", 1},
+	} {
+		offsets := scanRecordOffsets(strings.NewReader(positionsDoc), nil)
+		if len(offsets) != 2 {
+			t.Fatalf("found %d records, want 2", len(offsets))
+		}
+		findings := []api.Finding{{Path: test.path, Record: test.record}}
+		locateFindings(findings, offsets, strings.NewReader(positionsDoc))
+		f := findings[0]
+
+		wantRecord := positionOf(positionsDoc, int(offsets[test.record]))
+		if f.RecordPosition == nil || *f.RecordPosition != wantRecord {
+			t.Errorf("%s: record at %+v, want %+v", test.path, f.RecordPosition, wantRecord)
+		}
+		if test.value == "" {
+			if f.Position != nil {
+				t.Errorf("%s: found at %+v, want not found", test.path, *f.Position)
+			}
+			continue
+		}
+		start := int(offsets[test.record])
+		want := positionOf(positionsDoc, start+strings.Index(positionsDoc[start:], test.value))
+		if f.Position == nil || *f.Position != want {
+			t.Errorf("%s: found at %+v, want %+v", test.path, f.Position, want)
+		}
+	}
+}
+
+func TestLocateFindingsWithoutSource(t *testing.T) {
+	offsets := scanRecordOffsets(strings.NewReader(positionsDoc), nil)
+	findings := []api.Finding{{Path: "(root).1.n", Record: 1}, {Path: "(root).1", Record: 1}}
+	locateFindings(findings, offsets, nil)
+	for _, f := range findings {
+		want := api.Position{Offset: offsets[1]}
+		if f.RecordPosition == nil || *f.RecordPosition != want {
+			t.Errorf("%s: record at %+v, want %+v", f.Path, f.RecordPosition, want)
+		}
+	}
+	if findings[0].Position != nil {
+		t.Errorf("found a value without a source")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// Report formats, besides the plain ValidationResponse JSON.
+const (
+	formatJSON  = "json"
+	formatJUnit = "junit"
+	formatSARIF = "sarif"
+	formatHTML  = "html"
+	formatCSV   = "csv"
+)
+
+var reportContentTypes = map[string]string{
+	formatJSON:  "application/json",
+	formatJUnit: "application/xml",
+	formatSARIF: "application/sarif+json",
+	formatHTML:  "text/html; charset=utf-8",
+	formatCSV:   "text/csv; charset=utf-8",
+}
+
+var reportExtensions = map[string]string{
+	formatJSON:  "json",
+	formatJUnit: "xml",
+	formatSARIF: "sarif",
+	formatHTML:  "html",
+	formatCSV:   "csv",
+}
+
+// namedResponse is a validation response for a named file or URL.
+type namedResponse struct {
+	Name string
+	api.ValidationResponse
+	// Snippets holds the text of records with findings, by record index,
+	// for HTML reports, and NPIs their npi, for CSV reports of providers
+	// files. They are only filled in if the document could be re-read.
+	Snippets map[int]string
+	NPIs     map[int]string
+}
+
+// fillRecordDetails re-reads src for the record details format uses.
+func (resp *namedResponse) fillRecordDetails(format string, src io.ReadSeeker) {
+	switch {
+	case format == formatHTML:
+		resp.Snippets = recordSnippets(resp.Findings, src)
+	case format == formatCSV && resp.Schema == "providers":
+		resp.NPIs = recordNPIs(resp.Findings, src)
+	}
+}
+
+// responseFormat picks the report format for a request from its "format"
+// parameter, or failing that its Accept header.
+func responseFormat(format, accept string) string {
+	if format != "" {
+		return format
+	}
+	switch {
+	// browsers ask for XML too, but after HTML
+	case strings.Contains(accept, "text/html"):
+		return formatHTML
+	case strings.Contains(accept, "application/sarif+json"):
+		return formatSARIF
+	case strings.Contains(accept, "xml"):
+		return formatJUnit
+	}
+	return formatJSON
+}
+
+// writeReport writes resps as a JUnit, SARIF, HTML or CSV report.
+func writeReport(w io.Writer, format string, resps []namedResponse) error {
+	switch format {
+	case formatCSV:
+		return writeCSV(w, resps)
+	case formatHTML:
+		return writeHTML(w, resps)
+	case formatJUnit:
+		return writeJUnit(w, resps)
+	case formatSARIF:
+		return writeSARIF(w, resps)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// serveReport writes resps in the given format, or returns false if it is
+// plain JSON. If download is set, browsers are asked to save the report.
+func serveReport(w http.ResponseWriter, format string, download bool, resps []namedResponse) bool {
+	if format == formatJSON {
+		return false
+	}
+	contentType, ok := reportContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), 400)
+		return true
+	}
+	w.Header().Set("Content-Type", contentType)
+	if download {
+		w.Header().Set("Content-Disposition", `attachment; filename="validation-report.`+reportExtensions[format]+`"`)
+	}
+	if err := writeReport(w, format, resps); err != nil {
+		logger.Errorf("error writing %s report: %v", format, err)
+	}
+	return true
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes a test suite per response, with a test case per rule
+// and path that failed. Warnings become passing test cases with the
+// warnings as their output, and a valid document without warnings is a
+// single passing test case.
+func writeJUnit(w io.Writer, resps []namedResponse) error {
+	suites := junitTestSuites{Name: "coverage-validator"}
+	for _, resp := range resps {
+		suite := junitTestSuite{Name: resp.Name}
+		for _, s := range resp.Summary {
+			tc := junitTestCase{
+				ClassName: resp.Schema,
+				Name:      strings.TrimSpace(s.Rule + " " + s.Path),
+			}
+			if tc.Name == "" {
+				tc.Name = s.Message
+			}
+			text := junitFindings(resp.Findings, s)
+			if s.Severity == api.SeverityError {
+				tc.Failure = &junitFailure{
+					Message: fmt.Sprintf("%s (%d)", s.Message, s.Count),
+					Type:    s.Rule,
+					Text:    text,
+				}
+				suite.Failures++
+			} else {
+				tc.SystemOut = text
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		if len(suite.Cases) == 0 {
+			suite.Cases = append(suite.Cases, junitTestCase{ClassName: resp.Schema, Name: resp.Schema})
+		}
+		suite.Tests = len(suite.Cases)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// groupFindings returns the findings in the summary group s.
+func groupFindings(findings []api.Finding, s api.RuleSummary) []api.Finding {
+	var group []api.Finding
+	for _, f := range findings {
+		if f.Severity == s.Severity && f.Description == s.Message && pathTemplate(f.Path) == s.Path {
+			group = append(group, f)
+		}
+	}
+	return group
+}
+
+// junitFindings lists the findings in the summary group s, one per line.
+func junitFindings(findings []api.Finding, s api.RuleSummary) string {
+	var lines []string
+	for _, f := range groupFindings(findings, s) {
+		lines = append(lines, findingLocation(f)+f.Message)
+	}
+	if n := s.Count - len(lines); n > 0 {
+		lines = append(lines, fmt.Sprintf("... and %d more", n))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findingLocation returns "line L, column C: " for a finding with a known
+// position, or "".
+func findingLocation(f api.Finding) string {
+	pos := f.Position
+	if pos == nil {
+		pos = f.RecordPosition
+	}
+	if pos == nil || pos.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("line %d, column %d: ", pos.Line, pos.Column)
+}
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId,omitempty"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int   `json:"startLine,omitempty"`
+	StartColumn int   `json:"startColumn,omitempty"`
+	ByteOffset  int64 `json:"byteOffset"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// writeSARIF writes a single SARIF 2.1 run with a result per listed finding,
+// located by file, line and column where known and by JSONPath.
+func writeSARIF(w io.Writer, resps []namedResponse) error {
+	run := sarifRun{
+		Tool:    sarifTool{Driver: sarifDriver{Name: "coverage-validator", Rules: []sarifRule{}}},
+		Results: []sarifResult{},
+	}
+	seenRules := make(map[string]bool)
+	for _, resp := range resps {
+		for _, f := range resp.Findings {
+			if f.Rule != "" && !seenRules[f.Rule] {
+				seenRules[f.Rule] = true
+				run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: f.Rule})
+			}
+			result := sarifResult{
+				RuleID:  f.Rule,
+				Level:   f.Severity,
+				Message: sarifMessage{Text: f.Message},
+			}
+			loc := sarifLocation{
+				PhysicalLocation: &sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: resp.Name}},
+			}
+			pos := f.Position
+			if pos == nil {
+				pos = f.RecordPosition
+			}
+			if pos != nil {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: pos.Line, StartColumn: pos.Column, ByteOffset: pos.Offset}
+			}
+			if f.Path != "" {
+				loc.LogicalLocations = []sarifLogicalLocation{{FullyQualifiedName: jsonPath(f.Path), Kind: "element"}}
+			}
+			result.Locations = []sarifLocation{loc}
+			run.Results = append(run.Results, result)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{Version: "2.1.0", Schema: sarifSchema, Runs: []sarifRun{run}})
+}
+
+// jsonPath turns a gojsonschema context like "(root).3.plans.0.plan_id" into
+// the JSONPath "$[3].plans[0].plan_id".
+func jsonPath(path string) string {
+	p := "$"
+	for _, seg := range pathSegments(path) {
+		if _, err := strconv.Atoi(seg); err == nil {
+			p += "[" + seg + "]"
+		} else {
+			p += "." + seg
+		}
+	}
+	return p
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// Streamed response formats.
+const (
+	formatNDJSON = "ndjson"
+	formatSSE    = "sse"
+)
+
+// progressInterval is how often a streamed response reports progress.
+const progressInterval = time.Second
+
+// streamFormat returns the streamed response format a request asks for with
+// its "format" parameter or Accept header, or "" for an ordinary response.
+func streamFormat(format, accept string) string {
+	switch format {
+	case formatNDJSON, formatSSE:
+		return format
+	case "":
+		switch {
+		case strings.Contains(accept, "text/event-stream"):
+			return formatSSE
+		case strings.Contains(accept, "application/x-ndjson"):
+			return formatNDJSON
+		}
+	}
+	return ""
+}
+
+// eventStream writes a /validate response as a stream of api.StreamEvents:
+// progress and findings while the document is validated, then the result.
+// Our own NPI and schema checks' findings are sent as they are found, but
+// the coverage validators only hand back theirs once they finish.
+type eventStream struct {
+	w      http.ResponseWriter
+	format string
+	v      Validator
+	file   *os.File
+
+	// mu serializes events, which the checks send as well as validate
+	mu      sync.Mutex
+	started bool
+	// sent holds the findings sent so far, by severity and message
+	sent     map[string]bool
+	errsSent int
+}
+
+func newEventStream(w http.ResponseWriter, format string, v Validator) *eventStream {
+	return &eventStream{w: w, format: format, v: v, sent: make(map[string]bool)}
+}
+
+// validate is a docValidator. The document is spooled to disk before any
+// events are sent, since an HTTP/1.x request body can't be read once the
+// response has started; the server can't read and write at once.
+func (s *eventStream) validate(resp *api.ValidationResponse, doc io.Reader) (io.ReadSeeker, error) {
+	f, err := ioutil.TempFile("", "coverage-validator-stream-")
+	if err != nil {
+		result := coverage.NewValidationErrorResult(err)
+		renderWarningsErrors(resp, &result)
+		return nil, nil
+	}
+	s.file = f
+	total, err := spoolUpload(f, doc)
+	if _, ok := err.(*uploadError); ok {
+		return nil, err
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		result := coverage.NewValidationErrorResult(err)
+		renderWarningsErrors(resp, &result)
+		return nil, nil
+	}
+
+	var (
+		records, bytes int64
+		result         core.ValidationResult
+		offsets        []int64
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, offsets = s.v.validateLocated(resp, &countingReader{r: f, n: &bytes}, &records, s.report(resp.MaxErrors))
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+		}
+		s.send(api.StreamEvent{
+			Event:      api.EventProgress,
+			Records:    atomic.LoadInt64(&records),
+			Bytes:      atomic.LoadInt64(&bytes),
+			BytesTotal: total,
+		})
+	}
+
+	renderWarningsErrors(resp, &result)
+	locateFindings(resp.Findings, offsets, f)
+	return f, nil
+}
+
+// report sends the findings of the checks' partial results as they are
+// found, up to maxErrors errors. Their positions aren't known until the
+// whole document has been read, so they come with the result.
+func (s *eventStream) report(maxErrors int) reporter {
+	return func(result core.ValidationResult) {
+		for _, err := range result.Errs {
+			s.sendFinding(newFinding(api.SeverityError, err.Error()), maxErrors)
+		}
+		for _, warning := range result.Warnings {
+			s.sendFinding(newFinding(api.SeverityWarning, warning.Warning()), maxErrors)
+		}
+	}
+}
+
+// sendFinding sends f unless it has been sent already, or it is an error
+// and maxErrors have been.
+func (s *eventStream) sendFinding(f api.Finding, maxErrors int) {
+	key := f.Severity + "\x00" + f.Message
+	s.mu.Lock()
+	if s.sent[key] || (f.Severity == api.SeverityError && maxErrors > 0 && s.errsSent >= maxErrors) {
+		s.mu.Unlock()
+		return
+	}
+	s.sent[key] = true
+	if f.Severity == api.SeverityError {
+		s.errsSent++
+	}
+	s.mu.Unlock()
+	s.send(api.StreamEvent{Event: api.EventFinding, Finding: &f})
+}
+
+// finish sends those of resp's findings that haven't been sent, and then
+// resp itself, with all its findings located.
+func (s *eventStream) finish(resp api.ValidationResponse) {
+	for _, f := range resp.Findings {
+		s.sendFinding(f, resp.MaxErrors)
+	}
+	s.send(api.StreamEvent{Event: api.EventResult, Result: &resp})
+}
+
+// close removes the spooled document.
+func (s *eventStream) close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+func (s *eventStream) send(event api.StreamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.started = true
+		if s.format == formatSSE {
+			s.w.Header().Set("Content-Type", "text/event-stream")
+			s.w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			s.w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("error encoding %s event: %v", event.Event, err)
+		return
+	}
+	if s.format == formatSSE {
+		_, err = io.WriteString(s.w, "event: "+event.Event+"\ndata: "+string(data)+"\n\n")
+	} else {
+		_, err = s.w.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logger.Errorf("error writing %s event: %v", event.Event, err)
+		return
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
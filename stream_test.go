@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+func TestStreamSendsFindingsOnce(t *testing.T) {
+	v := testCrawler(t).Validator
+	// the second NPI has a bad check digit
+	doc := `[{"npi": "1234567893", "type": "INDIVIDUAL"}, {"npi": "1234567890", "type": "INDIVIDUAL"}]`
+	req := httptest.NewRequest("POST", "/validate?schema=providers&year=2017", strings.NewReader(doc))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	v.ServeHTTP(w, req)
+
+	sent := make(map[string]bool)
+	var result *api.ValidationResponse
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var event api.StreamEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if result != nil {
+			t.Fatalf("%s event after the result", event.Event)
+		}
+		switch event.Event {
+		case api.EventFinding:
+			if sent[event.Finding.Message] {
+				t.Errorf("sent %q twice", event.Finding.Message)
+			}
+			sent[event.Finding.Message] = true
+		case api.EventResult:
+			result = event.Result
+		}
+	}
+	if result == nil {
+		t.Fatal("no result event")
+	}
+
+	checksum := false
+	for _, f := range result.Findings {
+		if !sent[f.Message] {
+			t.Errorf("%q wasn't sent", f.Message)
+		}
+		if f.Description == npiInvalidChecksum {
+			checksum = true
+			if f.Position == nil {
+				t.Errorf("%q has no position", f.Message)
+			}
+		}
+	}
+	if !checksum {
+		t.Errorf("bad check digit not found: %v", result.Errors)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adhocteam/qhpvalidator/api"
+	js "github.com/xeipuuv/gojsonschema"
+)
+
+// maxSummaryRecords is how many example record indexes a RuleSummary lists.
+const maxSummaryRecords = 5
+
+// summarize groups findings, most frequent first.
+func summarize(findings []api.Finding) []api.RuleSummary {
+	summaries := []api.RuleSummary{}
+	groups := make(map[string]int)
+	// listed holds the records each group lists, by group and record
+	listed := make(map[[2]int]bool)
+	for _, f := range findings {
+		path := pathTemplate(f.Path)
+		key := f.Severity + "\x00" + path + "\x00" + f.Description
+		i, ok := groups[key]
+		if !ok {
+			i = len(summaries)
+			groups[key] = i
+			summaries = append(summaries, api.RuleSummary{
+				Severity: f.Severity,
+				Rule:     f.Rule,
+				Path:     path,
+				Message:  f.Description,
+				Records:  []int{},
+			})
+		}
+		s := &summaries[i]
+		s.Count++
+		if f.Record >= 0 && len(s.Records) < maxSummaryRecords && !listed[[2]int{i, f.Record}] {
+			listed[[2]int{i, f.Record}] = true
+			s.Records = append(s.Records, f.Record)
+		}
+	}
+	sort.Stable(byCount(summaries))
+	return summaries
+}
+
+type byCount []api.RuleSummary
+
+func (s byCount) Len() int           { return len(s) }
+func (s byCount) Less(i, j int) bool { return s[i].Count > s[j].Count }
+func (s byCount) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// pathTemplate turns a gojsonschema context like "(root).3.addresses.0.zip"
+// into "[*].addresses[*].zip".
+func pathTemplate(path string) string {
+	if path == "" || path == js.STRING_CONTEXT_ROOT {
+		return path
+	}
+	var buf bytes.Buffer
+	for _, part := range strings.Split(strings.TrimPrefix(path, js.STRING_CONTEXT_ROOT+"."), ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			buf.WriteString("[*]")
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('.')
+		}
+		buf.WriteString(part)
+	}
+	return buf.String()
+}
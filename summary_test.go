@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+func TestSummarizeListsEachRecordOnce(t *testing.T) {
+	finding := func(record int) api.Finding {
+		return api.Finding{Severity: api.SeverityError, Path: "(root).0.npi", Record: record, Description: "bad npi"}
+	}
+	// schema errors come before overlay errors, so a record can come round
+	// again
+	findings := []api.Finding{finding(0), finding(1), finding(0), finding(2), finding(1), finding(3), finding(4), finding(5)}
+	summaries := summarize(findings)
+	if len(summaries) != 1 {
+		t.Fatalf("got %d summaries, want 1", len(summaries))
+	}
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(summaries[0].Records, want) {
+		t.Errorf("records %v, want %v", summaries[0].Records, want)
+	}
+	if summaries[0].Count != len(findings) {
+		t.Errorf("count %d, want %d", summaries[0].Count, len(findings))
+	}
+}
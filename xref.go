@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/core"
+	js "github.com/xeipuuv/gojsonschema"
+)
+
+// planIDPattern is the plan_id pattern shared by the plans, providers and
+// drugs schemas. References that don't match it are left to the schema
+// validators to report.
+var planIDPattern = regexp.MustCompile(`^[0-9]{5}[A-Z]{2}[0-9]{7}$`)
+
+// Cross-document reference errors. They are formatted like gojsonschema
+// errors so they can be parsed into Findings.
+const (
+	xrefPlanNotFound        = "plan_id not found in plans file"
+	xrefNetworkTierNotFound = "network_tier not in network of plan %s"
+	xrefDrugTierNotFound    = "drug_tier not in formulary of plan %s"
+)
+
+type planRefs struct {
+	networkTiers map[string]bool
+	drugTiers    map[string]bool
+}
+
+// PlanIndex records the plan_ids in an issuer's plans files along with each
+// plan's network and formulary tiers, so that providers and drugs files can
+// be checked for dangling references.
+type PlanIndex struct {
+	plans map[string]*planRefs
+	// incomplete is set if a plans file couldn't be read in full, so that
+	// missing plans can't be told from plans the index never saw.
+	incomplete bool
+}
+
+func NewPlanIndex() *PlanIndex {
+	return &PlanIndex{plans: make(map[string]*planRefs)}
+}
+
+type formularyTier struct {
+	DrugTier string `json:"drug_tier"`
+}
+
+// Add reads a plans file into the index. Plans that don't have the expected
+// shape are skipped; the plans schema validator reports those.
+func (idx *PlanIndex) Add(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return decodeArray(dec, func(i int) error {
+		var plan struct {
+			PlanID  string `json:"plan_id"`
+			Network []struct {
+				NetworkTier string `json:"network_tier"`
+			} `json:"network"`
+			Formulary json.RawMessage `json:"formulary"`
+		}
+		if err := dec.Decode(&plan); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				return nil
+			}
+			return err
+		}
+
+		refs := idx.plans[plan.PlanID]
+		if refs == nil {
+			refs = &planRefs{networkTiers: make(map[string]bool), drugTiers: make(map[string]bool)}
+			idx.plans[plan.PlanID] = refs
+		}
+		for _, n := range plan.Network {
+			refs.networkTiers[n.NetworkTier] = true
+		}
+
+		// formulary is either a single tier or an array of them
+		var tiers []formularyTier
+		if f := bytes.TrimSpace(plan.Formulary); len(f) > 0 && f[0] == '[' {
+			json.Unmarshal(f, &tiers)
+		} else if len(f) > 0 {
+			var tier formularyTier
+			json.Unmarshal(f, &tier)
+			tiers = append(tiers, tier)
+		}
+		for _, t := range tiers {
+			refs.drugTiers[t.DrugTier] = true
+		}
+		return nil
+	})
+}
+
+// CheckProviders reports plans referenced from a providers file that are
+// missing from the index or whose network_tier isn't in the plan's network.
+func (idx *PlanIndex) CheckProviders(r io.Reader, maxErrs int) core.ValidationResult {
+	return idx.check(r, maxErrs, "network_tier", xrefNetworkTierNotFound, func(p *planRefs) map[string]bool {
+		return p.networkTiers
+	})
+}
+
+// CheckDrugs reports plans referenced from a drugs file that are missing from
+// the index or whose drug_tier isn't in the plan's formulary.
+func (idx *PlanIndex) CheckDrugs(r io.Reader, maxErrs int) core.ValidationResult {
+	return idx.check(r, maxErrs, "drug_tier", xrefDrugTierNotFound, func(p *planRefs) map[string]bool {
+		return p.drugTiers
+	})
+}
+
+func (idx *PlanIndex) check(r io.Reader, maxErrs int, tierField, tierMsg string, tiers func(*planRefs) map[string]bool) core.ValidationResult {
+	var result core.ValidationResult
+	dec := json.NewDecoder(r)
+	err := decodeArray(dec, func(i int) error {
+		var record struct {
+			Plans []map[string]interface{} `json:"plans"`
+		}
+		if err := dec.Decode(&record); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				return nil
+			}
+			return err
+		}
+
+		for j, plan := range record.Plans {
+			planID, _ := plan["plan_id"].(string)
+			if !planIDPattern.MatchString(planID) {
+				continue
+			}
+			context := js.STRING_CONTEXT_ROOT + "." + strconv.Itoa(i) + ".plans." + strconv.Itoa(j)
+			refs, ok := idx.plans[planID]
+			if !ok {
+				result.Errs = append(result.Errs, xrefError(context+".plan_id", xrefPlanNotFound, planID))
+			} else if tier, ok := plan[tierField].(string); ok && !tiers(refs)[tier] {
+				result.Errs = append(result.Errs, xrefError(context+"."+tierField, fmt.Sprintf(tierMsg, planID), tier))
+			}
+			if maxErrs > 0 && len(result.Errs) >= maxErrs {
+				return errMaxErrs
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errMaxErrs {
+		// malformed JSON is reported by the schema validators
+		logger.Infof("cross-checking plan references: %v", err)
+	}
+	return result
+}
+
+var errMaxErrs = errors.New("validator: too many errors")
+
+func xrefError(context, description string, value interface{}) error {
+	v, _ := json.Marshal(value)
+	return errors.New(fmt.Sprintf(js.RESULT_ERROR_FORMAT, context, description, v))
+}
+
+// decodeArray reads a top-level JSON array from dec, calling fn with the
+// index of each element. fn is responsible for decoding the element.
+func decodeArray(dec *json.Decoder, fn func(i int) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("expected a JSON array")
+	}
+	for i := 0; dec.More(); i++ {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// teeValidate runs validate and check over the same stream so that large
+// files are only read once, and merges their results. check sees whatever
+// validate reads; if validate stops early, check stops there too. A nil
+// check just runs validate.
+func teeValidate(r io.Reader, validate, check func(io.Reader) core.ValidationResult) core.ValidationResult {
+	if check == nil {
+		return validate(r)
+	}
+
+	pr, pw := io.Pipe()
+	checked := make(chan core.ValidationResult, 1)
+	go func() {
+		result := check(pr)
+		// keep draining so validate never blocks on the pipe
+		io.Copy(ioutil.Discard, pr)
+		checked <- result
+	}()
+
+	result := validate(io.TeeReader(r, pw))
+	pw.Close()
+	extra := <-checked
+
+	result.Errs = append(result.Errs, extra.Errs...)
+	result.Warnings = append(result.Warnings, extra.Warnings...)
+	return result
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.cms.gov/CMS-WDS/marketplace-api/marketplace/coverage"
+	"github.com/adhocteam/qhpvalidator/api"
+)
+
+// supportedYears are the plan years requests may ask for.
+var supportedYears = yearList{2016, 2017, 2018}
+
+func init() {
+	flag.Var(&supportedYears, "years", "comma-separated plan years that may be validated for")
+}
+
+// yearList is a flag.Value holding comma-separated years.
+type yearList []int
+
+func (l *yearList) String() string {
+	years := make([]string, len(*l))
+	for i, y := range *l {
+		years[i] = strconv.Itoa(y)
+	}
+	return strings.Join(years, ",")
+}
+
+func (l *yearList) Set(s string) error {
+	var years yearList
+	for _, f := range strings.Split(s, ",") {
+		y, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return fmt.Errorf("invalid year %q", f)
+		}
+		years = append(years, y)
+	}
+	*l = years
+	return nil
+}
+
+// Years returns the supported plan years that name has a schema for.
+func (v Validator) Years(name string) []int {
+	years := []int{}
+	for _, y := range supportedYears {
+		if _, ok := v.lookup(name, coverage.Year2SchemaYear(y)); ok {
+			years = append(years, y)
+		}
+	}
+	return years
+}
+
+// Schemas lists the registered schemas and the plan years each supports.
+func (v Validator) Schemas() []api.SchemaInfo {
+	seen := make(map[string]bool)
+	var names []string
+	for key := range v {
+		if !seen[key.name] {
+			seen[key.name] = true
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+
+	schemas := make([]api.SchemaInfo, len(names))
+	for i, name := range names {
+		schemas[i] = api.SchemaInfo{Name: name, Years: v.Years(name)}
+	}
+	return schemas
+}
+
+// yearError is returned for a missing, malformed or unsupported year.
+type yearError struct {
+	msg       string
+	supported []int
+}
+
+func (e *yearError) Error() string {
+	return e.msg
+}
+
+// parseYear checks a requested plan year, returning its schema year. The
+// year must be one schemaName supports; for unknown schemas, which Validate
+// reports, it need only be one of the supported years.
+func (v Validator) parseYear(schemaName, s string) (int, error) {
+	years := v.Years(schemaName)
+	if len(years) == 0 {
+		years = supportedYears
+	}
+	if s == "" {
+		return 0, &yearError{"year is required", years}
+	}
+	year, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, &yearError{fmt.Sprintf("invalid year %q", s), years}
+	}
+	for _, y := range years {
+		if y == year {
+			return coverage.Year2SchemaYear(year), nil
+		}
+	}
+	return 0, &yearError{fmt.Sprintf("year %d is not supported for %s", year, schemaName), years}
+}
+
+// writeBadRequest responds 400 with an api.ErrorResponse for err.
+func writeBadRequest(w http.ResponseWriter, err error) {
+	resp := api.ErrorResponse{Error: err.Error()}
+	if yerr, ok := err.(*yearError); ok {
+		resp.SupportedYears = yerr.supported
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Errorf("error writing bad request response: %v", err)
+	}
+}
+
+// ServeSchemas handles GETs to /schemas, listing the schemas and the plan
+// years each supports.
+func (v Validator) ServeSchemas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v.Schemas()); err != nil {
+		http.Error(w, http.StatusText(500), 500)
+	}
+}